@@ -5,8 +5,10 @@ go 1.14
 require (
 	github.com/antonfisher/nested-logrus-formatter v1.1.0
 	github.com/go-sql-driver/mysql v1.5.0
+	github.com/golang/snappy v0.0.4
 	github.com/lib/pq v1.8.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	gopkg.in/ini.v1 v1.60.0
+	gopkg.in/yaml.v2 v2.4.0
 )
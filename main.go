@@ -1,9 +1,12 @@
 package main
 
 import (
+    "context"
     "flag"
     "fmt"
     "os"
+    "os/signal"
+    "syscall"
     "time"
 
     "gopkg.in/ini.v1"
@@ -19,9 +22,25 @@ const (
     CFG_S_OLD_K_DBUSER = "db_user"
     CFG_S_OLD_K_DBPASSWD = "db_passwd"
     CFG_S_OLD_K_DBSCHEMA = "db_schema"
+    CFG_S_OLD_K_DBMAXOPEN = "db_max_open_conns"
+    CFG_S_OLD_K_DBMAXIDLE = "db_max_idle_conns"
     CFG_S_OLD_K_APIURL = "api_url"
     CFG_S_OLD_K_APIUSER = "api_user"
     CFG_S_OLD_K_APIPASSWD = "api_passwd"
+    CFG_S_OLD_K_APITOKEN = "api_token"
+    CFG_S_OLD_K_APIRETRIES = "api_retries"
+    CFG_S_OLD_K_APIRETRYWAIT = "api_retry_wait"
+    CFG_S_OLD_K_APICAFILE = "api_ca_file"
+    CFG_S_OLD_K_APICERTFILE = "api_cert_file"
+    CFG_S_OLD_K_APIKEYFILE = "api_key_file"
+    CFG_S_OLD_K_APIINSECURE = "api_insecure_skip_verify"
+    CFG_S_OLD_K_APIBASICUSER = "api_basic_user"
+    CFG_S_OLD_K_APIBASICPASSWD = "api_basic_passwd"
+    CFG_S_OLD_K_APIPROXY = "api_proxy"
+    CFG_S_OLD_K_APITIMEOUT = "api_timeout"
+    CFG_S_OLD_K_HISTORYURL = "history_url"
+    CFG_S_OLD_K_HISTORYTYPES = "history_types"
+    CFG_S_OLD_K_HISTORYDATEINDEX = "history_date_index"
 
     CFG_S_NEW = "new"
     CFG_S_NEW_K_DBDRIVER = "db_driver"
@@ -30,9 +49,25 @@ const (
     CFG_S_NEW_K_DBUSER = "db_user"
     CFG_S_NEW_K_DBPASSWD = "db_passwd"
     CFG_S_NEW_K_DBSCHEMA = "db_schema"
+    CFG_S_NEW_K_DBMAXOPEN = "db_max_open_conns"
+    CFG_S_NEW_K_DBMAXIDLE = "db_max_idle_conns"
     CFG_S_NEW_K_APIURL = "api_url"
     CFG_S_NEW_K_APIUSER = "api_user"
     CFG_S_NEW_K_APIPASSWD = "api_passwd"
+    CFG_S_NEW_K_APITOKEN = "api_token"
+    CFG_S_NEW_K_APIRETRIES = "api_retries"
+    CFG_S_NEW_K_APIRETRYWAIT = "api_retry_wait"
+    CFG_S_NEW_K_APICAFILE = "api_ca_file"
+    CFG_S_NEW_K_APICERTFILE = "api_cert_file"
+    CFG_S_NEW_K_APIKEYFILE = "api_key_file"
+    CFG_S_NEW_K_APIINSECURE = "api_insecure_skip_verify"
+    CFG_S_NEW_K_APIBASICUSER = "api_basic_user"
+    CFG_S_NEW_K_APIBASICPASSWD = "api_basic_passwd"
+    CFG_S_NEW_K_APIPROXY = "api_proxy"
+    CFG_S_NEW_K_APITIMEOUT = "api_timeout"
+    CFG_S_NEW_K_HISTORYURL = "history_url"
+    CFG_S_NEW_K_HISTORYTYPES = "history_types"
+    CFG_S_NEW_K_HISTORYDATEINDEX = "history_date_index"
 )
 
 // app info
@@ -54,9 +89,18 @@ var (
     aZDBUser        string
     aZDBPasswd      string
     aZDBDatabase    string
+    aZDBMaxOpen     int
+    aZDBMaxIdle     int
     aZAPIUrl        string
     aZAPIUser       string
     aZAPIPasswd     string
+    aZAPIToken      string
+    aZAPIRetries    int
+    aZAPIRetryWait  time.Duration
+    aZAPITransport  APITransport
+    aZHistoryURL    string
+    aZHistoryTypes  string
+    aZHistoryDateIndex  bool
 
     // new zabbix config
     bZDBDriver      string
@@ -65,9 +109,18 @@ var (
     bZDBUser        string
     bZDBPasswd      string
     bZDBDatabase    string
+    bZDBMaxOpen     int
+    bZDBMaxIdle     int
     bZAPIUrl        string
     bZAPIUser       string
     bZAPIPasswd     string
+    bZAPIToken      string
+    bZAPIRetries    int
+    bZAPIRetryWait  time.Duration
+    bZAPITransport  APITransport
+    bZHistoryURL    string
+    bZHistoryTypes  string
+    bZHistoryDateIndex  bool
 )
 
 // flag
@@ -88,6 +141,33 @@ var (
 
     fIgnore         bool
 
+    fWorkers        uint
+    fWorkUnit       string
+    fBatchSize      uint
+    fBulkLoad       bool
+
+    fCheckpoint     string
+    fResume         bool
+    fFresh          bool
+    fFrom           string
+    fTo             string
+    fFollow         time.Duration
+    fValidate       bool
+    fTSDBDecompress bool
+    fLLDWait        time.Duration
+    fRename         string
+    fLossy          bool
+    fExportDir      string
+    fExportFormat   string
+    fExportChunk    uint
+    fRWUrl          string
+    fRWBatch        uint
+    fInfluxUrl      string
+    fInfluxBatch    uint
+    fParquetRowGroup    uint
+    fVerifyBucket   time.Duration
+    fVerifyReport   string
+
     fLogLevel       uint
 )
 
@@ -124,9 +204,27 @@ func initConfig() error {
     aZDBUser        = sOLD.Key(CFG_S_OLD_K_DBUSER).Value()
     aZDBPasswd      = sOLD.Key(CFG_S_OLD_K_DBPASSWD).Value()
     aZDBDatabase    = sOLD.Key(CFG_S_OLD_K_DBSCHEMA).Value()
+    aZDBMaxOpen, _  = sOLD.Key(CFG_S_OLD_K_DBMAXOPEN).Int()
+    aZDBMaxIdle, _  = sOLD.Key(CFG_S_OLD_K_DBMAXIDLE).Int()
     aZAPIUrl        = sOLD.Key(CFG_S_OLD_K_APIURL).Value()
     aZAPIUser       = sOLD.Key(CFG_S_OLD_K_APIUSER).Value()
     aZAPIPasswd     = sOLD.Key(CFG_S_OLD_K_APIPASSWD).Value()
+    aZAPIToken      = sOLD.Key(CFG_S_OLD_K_APITOKEN).Value()
+    aZAPIRetries    = sOLD.Key(CFG_S_OLD_K_APIRETRIES).MustInt(DefaultAPIRetries)
+    aZAPIRetryWait  = sOLD.Key(CFG_S_OLD_K_APIRETRYWAIT).MustDuration(DefaultAPIRetryWait)
+    aZAPITransport  = APITransport{
+        CAFile: sOLD.Key(CFG_S_OLD_K_APICAFILE).Value(),
+        CertFile: sOLD.Key(CFG_S_OLD_K_APICERTFILE).Value(),
+        KeyFile: sOLD.Key(CFG_S_OLD_K_APIKEYFILE).Value(),
+        InsecureSkipVerify: sOLD.Key(CFG_S_OLD_K_APIINSECURE).MustBool(false),
+        BasicUser: sOLD.Key(CFG_S_OLD_K_APIBASICUSER).Value(),
+        BasicPasswd: sOLD.Key(CFG_S_OLD_K_APIBASICPASSWD).Value(),
+        Proxy: sOLD.Key(CFG_S_OLD_K_APIPROXY).Value(),
+        Timeout: sOLD.Key(CFG_S_OLD_K_APITIMEOUT).MustDuration(DefaultAPITimeout),
+    }
+    aZHistoryURL    = sOLD.Key(CFG_S_OLD_K_HISTORYURL).Value()
+    aZHistoryTypes  = sOLD.Key(CFG_S_OLD_K_HISTORYTYPES).Value()
+    aZHistoryDateIndex, _ = sOLD.Key(CFG_S_OLD_K_HISTORYDATEINDEX).Bool()
 
     sNEW, err := cfg.GetSection(CFG_S_NEW)
     if err != nil {
@@ -138,9 +236,27 @@ func initConfig() error {
     bZDBUser        = sNEW.Key(CFG_S_NEW_K_DBUSER).Value()
     bZDBPasswd      = sNEW.Key(CFG_S_NEW_K_DBPASSWD).Value()
     bZDBDatabase    = sNEW.Key(CFG_S_NEW_K_DBSCHEMA).Value()
+    bZDBMaxOpen, _  = sNEW.Key(CFG_S_NEW_K_DBMAXOPEN).Int()
+    bZDBMaxIdle, _  = sNEW.Key(CFG_S_NEW_K_DBMAXIDLE).Int()
     bZAPIUrl        = sNEW.Key(CFG_S_NEW_K_APIURL).Value()
     bZAPIUser       = sNEW.Key(CFG_S_NEW_K_APIUSER).Value()
     bZAPIPasswd     = sNEW.Key(CFG_S_NEW_K_APIPASSWD).Value()
+    bZAPIToken      = sNEW.Key(CFG_S_NEW_K_APITOKEN).Value()
+    bZAPIRetries    = sNEW.Key(CFG_S_NEW_K_APIRETRIES).MustInt(DefaultAPIRetries)
+    bZAPIRetryWait  = sNEW.Key(CFG_S_NEW_K_APIRETRYWAIT).MustDuration(DefaultAPIRetryWait)
+    bZAPITransport  = APITransport{
+        CAFile: sNEW.Key(CFG_S_NEW_K_APICAFILE).Value(),
+        CertFile: sNEW.Key(CFG_S_NEW_K_APICERTFILE).Value(),
+        KeyFile: sNEW.Key(CFG_S_NEW_K_APIKEYFILE).Value(),
+        InsecureSkipVerify: sNEW.Key(CFG_S_NEW_K_APIINSECURE).MustBool(false),
+        BasicUser: sNEW.Key(CFG_S_NEW_K_APIBASICUSER).Value(),
+        BasicPasswd: sNEW.Key(CFG_S_NEW_K_APIBASICPASSWD).Value(),
+        Proxy: sNEW.Key(CFG_S_NEW_K_APIPROXY).Value(),
+        Timeout: sNEW.Key(CFG_S_NEW_K_APITIMEOUT).MustDuration(DefaultAPITimeout),
+    }
+    bZHistoryURL    = sNEW.Key(CFG_S_NEW_K_HISTORYURL).Value()
+    bZHistoryTypes  = sNEW.Key(CFG_S_NEW_K_HISTORYTYPES).Value()
+    bZHistoryDateIndex, _ = sNEW.Key(CFG_S_NEW_K_HISTORYDATEINDEX).Bool()
 
     return nil
 }
@@ -149,9 +265,9 @@ func initFlag() error {
     flag.StringVar(&confPath, "f", "zabbix_migrate.ini", "set path of config file than ini format")
 
     flag.BoolVar(&helpFlag, "h", false, "show for help")
-    flag.StringVar(&migrateType, "m", "", "select the type of migrate, support for hostgroup|valuemap|template|host")
+    flag.StringVar(&migrateType, "m", "", "select the type of migrate, support for hostgroup|valuemap|template|host|lld")
     flag.StringVar(&checkType, "c", "", "select the type of check, support for hostgroup|host|item|trigger|valuemap|map|all")
-    flag.StringVar(&syncType, "s", "", "select the type of sync, support for trends|history")
+    flag.StringVar(&syncType, "s", "", "select the type of sync, support for trends|history|export|import|verify")
     flag.StringVar(&fHTable, "htable", "", "select the name of history table for sync")
 
     flag.StringVar(&fHostGroup, "g", "", "input params about hostgroup")
@@ -161,11 +277,44 @@ func initFlag() error {
 
     flag.BoolVar(&fIgnore, "ignore", false, "ignore migrate errors")
 
+    flag.UintVar(&fWorkers, "w", 1, "set number of concurrent workers for sync")
+    flag.StringVar(&fWorkUnit, "wunit", "host", "select the unit of work for sync workers, support for host|table|item")
+    flag.UintVar(&fBatchSize, "b", DefaultBatchSize, "set number of rows per insert statement for sync")
+    flag.BoolVar(&fBulkLoad, "bulk", false, "load synced history by postgres copy or mysql load data local, fall back to insert on failure")
+    flag.StringVar(&fCheckpoint, "checkpoint", "zabbix_migrate.checkpoint", "set path of checkpoint file for sync progress, empty to disable")
+    flag.BoolVar(&fResume, "resume", false, "resume sync from the progress and time window in checkpoint file")
+    flag.BoolVar(&fFresh, "fresh", false, "start the checkpoint file over and drop the progress in it")
+    flag.StringVar(&fFrom, "from", "", "set begin of sync time window, unix timestamp, date or duration back from now like 90d")
+    flag.StringVar(&fTo, "to", "", "set end of sync time window, unix timestamp, date or duration back from now, default -d for history")
+    flag.BoolVar(&fValidate, "validate", false, "only read and check sync rows against the new db columns, report values to be truncated or rejected")
+    flag.StringVar(&fRename, "rename", "", "set path of csv or yaml file to rename old hosts and item keys for mapping on new zabbix")
+    flag.StringVar(&fExportDir, "dir", "zabbix_export", "set directory of history files for -s export and import")
+    flag.StringVar(&fExportFormat, "format", ExportFormatNDJSON, "select the format of history files for -s export, support for ndjson|csv|parquet|remote-write|influx")
+    flag.StringVar(&fRWUrl, "rw-url", "", "set url of prometheus remote write endpoint for -s export -format remote-write")
+    flag.UintVar(&fRWBatch, "rw-batch", DefaultRemoteWriteBatch, "set number of samples per remote write request")
+    flag.DurationVar(&fVerifyBucket, "bucket", DefaultVerifyBucket, "set time bucket to compare row counts and checksums for -s verify")
+    flag.StringVar(&fVerifyReport, "report", "", "set path of csv file to write discrepancies of -s verify")
+    flag.StringVar(&fInfluxUrl, "influx-url", "", "set url of influxdb write endpoint for -s export -format influx, empty to write line protocol files")
+    flag.UintVar(&fInfluxBatch, "influx-batch", DefaultInfluxBatch, "set number of lines per influxdb write request")
+    flag.UintVar(&fParquetRowGroup, "parquet-row-group", DefaultParquetRowGroup, "set number of rows per row group of parquet files for -s export")
+    flag.UintVar(&fExportChunk, "chunk", DefaultExportChunk, "set max number of rows per history file for -s export")
+    flag.BoolVar(&fLossy, "lossy", false, "allow lossy value convert for items with changed value_type, like float to uint")
+    flag.DurationVar(&fLLDWait, "lldwait", 10*time.Minute, "set max time to wait for discovered items on new zabbix for -m lld")
+    flag.BoolVar(&fTSDBDecompress, "tsdb-decompress", false, "decompress timescaledb chunks in sync window of new db before sync and compress them after, needed before timescaledb 2.3 for history and 2.11 for trends")
+    flag.DurationVar(&fFollow, "follow", 0, "keep sync newer rows every interval like 5m until SIGINT or SIGTERM, needs checkpoint, only for -s history|trends")
+
     flag.UintVar(&fLogLevel, "l", 4, "set log level number, 0 is panic ... 6 is trace")
 
     flag.Usage = flagUsage
     flag.Parse()
 
+    if fFollow > 0 && syncType != "history" && syncType != "trends" {
+        return fmt.Errorf("-follow can only run with -s history or trends, not [%s]", syncType)
+    }
+    if fResume && fFresh {
+        return fmt.Errorf("-resume and -fresh can not run together")
+    }
+
     return nil
 }
 
@@ -180,15 +329,6 @@ func init() {
         }).Fatal(err)
     }
 
-    err = initFlag()
-    if err != nil {
-        log.WithFields(log.Fields{
-            "func": "init",
-            "step": "initFlag",
-        }).Fatal(err)
-    }
-
-    log.SetLevel(log.Level(fLogLevel))
 }
 
 func flagUsage() {
@@ -206,6 +346,16 @@ Options:`, appName, appVersion, appAuthor, appGitCommitHash, appBuildTime, appGo
 func main() {
     var err error
 
+    err = initFlag()
+    if err != nil {
+        log.WithFields(log.Fields{
+            "func": "init",
+            "step": "initFlag",
+        }).Fatal(err)
+    }
+
+    log.SetLevel(log.Level(fLogLevel))
+
     if helpFlag {
         flag.Usage()
         os.Exit(1)
@@ -226,66 +376,164 @@ func main() {
         "func": "main",
     }).Debugf("new zabbix url: %s", bZAPIUrl)
 
-    aZAPI, err = NewZabbixAPI(aZAPIUrl, aZAPIUser, aZAPIPasswd)
-    aZDB, err = NewZabbixDB(aZDBDriver, aZDBHost, aZDBPort, aZDBUser, aZDBPasswd, aZDBDatabase)
-    if err != nil {
+    // the offline sync modes run where only one of the databases can be reached
+    offline := syncType == "export" || syncType == "import"
+    if offline && (migrateType != "" || checkType != "") {
         log.WithFields(log.Fields{
             "func": "main",
-            "step": "db.connect",
-        }).Fatalf("connect for db [%s:%d] get error: %s", aZDBHost, aZDBPort, err)
+        }).Fatalf("sync %s can not run with migrate or check", syncType)
     }
-    bZAPI, err = NewZabbixAPI(bZAPIUrl, bZAPIUser, bZAPIPasswd)
-    bZDB, err = NewZabbixDB(bZDBDriver, bZDBHost, bZDBPort, bZDBUser, bZDBPasswd, bZDBDatabase)
-    if err != nil {
-        log.WithFields(log.Fields{
-            "func": "main",
-            "step": "db.connect",
-        }).Fatalf("connect for db [%s:%d] get error: %s", bZDBHost, bZDBPort, err)
+
+    // ctrl-c aborts the api calls in flight of migrate and check, and stops
+    // follow sync after its pass
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    if migrateType != "" || checkType != "" || fFollow > 0 {
+        sigCh := make(chan os.Signal, 1)
+        signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+        go func() {
+            <-sigCh
+            signal.Stop(sigCh)
+            cancel()
+        }()
     }
 
-    _, err = aZAPI.Login()
+    aZAPI, err = NewZabbixAPI(aZAPIUrl, aZAPIUser, aZAPIPasswd)
+    aZAPI.SetToken(aZAPIToken)
+    aZAPI.Retries, aZAPI.RetryWait = aZAPIRetries, aZAPIRetryWait
+    err = aZAPI.SetTransport(aZAPITransport)
     if err != nil {
         log.WithFields(log.Fields{
             "func": "main",
-            "step": "api.login",
-        }).Fatalf( "login for api [%s] get error: %s", aZAPI.url, err)
+            "step": "api.transport",
+        }).Fatalf("transport for api [%s] get error: %s", aZAPIUrl, err)
     }
-    _, err = bZAPI.Login()
+    if syncType != "import" {
+        aZDB, err = NewZabbixDB(aZDBDriver, aZDBHost, aZDBPort, aZDBUser, aZDBPasswd, aZDBDatabase)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "db.connect",
+            }).Fatalf("connect for db [%s:%d] get error: %s", aZDBHost, aZDBPort, err)
+        }
+        aZDB.SetConnPool(aZDBMaxOpen, aZDBMaxIdle)
+        if aZHistoryURL != "" {
+            aZDB.Elastic, err = NewElasticHistory(aZHistoryURL, aZHistoryTypes, aZHistoryDateIndex)
+            if err != nil {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "history.storage",
+                }).Fatalf("history storage [%s] get error: %s", aZHistoryURL, err)
+            }
+        }
+    }
+    bZAPI, err = NewZabbixAPI(bZAPIUrl, bZAPIUser, bZAPIPasswd)
+    bZAPI.SetToken(bZAPIToken)
+    bZAPI.Retries, bZAPI.RetryWait = bZAPIRetries, bZAPIRetryWait
+    err = bZAPI.SetTransport(bZAPITransport)
     if err != nil {
         log.WithFields(log.Fields{
             "func": "main",
-            "step": "api.login",
-        }).Fatalf( "login for api [%s] get error: %s", bZAPI.url, err)
+            "step": "api.transport",
+        }).Fatalf("transport for api [%s] get error: %s", bZAPIUrl, err)
     }
-
-    if aZAPI == nil || aZDB == nil {
-        log.WithFields(log.Fields{
-            "func": "main",
-        }).Fatal("the old zabbix api or db object is empty")
+    if syncType != "export" {
+        bZDB, err = NewZabbixDB(bZDBDriver, bZDBHost, bZDBPort, bZDBUser, bZDBPasswd, bZDBDatabase)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "db.connect",
+            }).Fatalf("connect for db [%s:%d] get error: %s", bZDBHost, bZDBPort, err)
+        }
+        bZDB.SetConnPool(bZDBMaxOpen, bZDBMaxIdle)
+        if bZHistoryURL != "" {
+            bZDB.Elastic, err = NewElasticHistory(bZHistoryURL, bZHistoryTypes, bZHistoryDateIndex)
+            if err != nil {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "history.storage",
+                }).Fatalf("history storage [%s] get error: %s", bZHistoryURL, err)
+            }
+        }
+        bZDB.BatchSize = int(fBatchSize)
+        bZDB.BulkLoad = fBulkLoad
+        bZDB.Lossy = fLossy
+        if fRename != "" {
+            bZDB.Rename, err = LoadRenameMap(fRename)
+            if err != nil {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "rename.load",
+                }).Fatalf("load rename map [%s] get error: %s", fRename, err)
+            }
+        }
     }
-    if bZAPI == nil || bZDB == nil {
+
+    if !offline {
+        _, err = aZAPI.Login(ctx)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "api.login",
+            }).Fatalf( "login for api [%s] get error: %s", aZAPI.url, err)
+        }
+        _, err = bZAPI.Login(ctx)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "api.login",
+            }).Fatalf( "login for api [%s] get error: %s", bZAPI.url, err)
+        }
+
+        if aZAPI == nil || aZDB == nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+            }).Fatal("the old zabbix api or db object is empty")
+        }
+        if bZAPI == nil || bZDB == nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+            }).Fatal("the new zabbix api or db object is empty")
+        }
+
+        err = CheckVersionPair(aZAPI, bZAPI)
+        if err == nil {
+            err = CheckDBVersion(aZAPI, aZDB)
+        }
+        if err == nil {
+            err = CheckDBVersion(bZAPI, bZDB)
+        }
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "api.version",
+            }).Fatal(err)
+        }
         log.WithFields(log.Fields{
             "func": "main",
-        }).Fatal("the new zabbix api or db object is empty")
+            "step": "api.version",
+        }).Infof("migrate from zabbix %s to zabbix %s", aZAPI.Version, bZAPI.Version)
     }
 
     if migrateType != "" {
         switch migrateType {
         case "hostgroup":
-            err = CreateNewHostGroup(aZAPI, bZAPI)
+            err = CreateNewHostGroup(ctx, aZAPI, bZAPI)
         case "valuemap":
-            err = CreateNewValuemap(aZAPI, bZAPI)
+            err = CreateNewValuemap(ctx, aZAPI, bZAPI)
         case "template":
-            err = CleanNewTemplate(bZAPI, bZDB)
+            err = CleanNewTemplate(ctx, bZAPI, bZDB)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
                     "step": "migrate.template",
                 }).Fatal("clean template on new zabbix failed")
             }
-            err = CreateNewTemplate(aZAPI, aZDB, bZAPI)
+            err = CreateNewTemplate(ctx, aZAPI, aZDB, bZAPI)
         case "host":
-            err = CreateNewHost(aZAPI, aZDB, bZAPI, fHostGroup, fHostIdBegin, fIdOffset, fIgnore)
+            err = CreateNewHost(ctx, aZAPI, aZDB, bZAPI, fHostGroup, fHostIdBegin, fIdOffset, fIgnore)
+        case "lld":
+            err = CreateNewDiscovered(ctx, aZDB, bZAPI, bZDB, fHostGroup, fHostIdBegin, fIdOffset, fLLDWait)
         }
         if err != nil {
             log.WithFields(log.Fields{
@@ -298,7 +546,7 @@ func main() {
     if checkType != "" {
         var isSame bool
         if checkType == "hostgroup" || checkType == "all" {
-            isSame, err = CheckHostGroup(aZAPI, bZAPI)
+            isSame, err = CheckHostGroup(ctx, aZAPI, bZAPI)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
@@ -313,7 +561,7 @@ func main() {
         }
 
         if checkType == "host" || checkType == "all" {
-            isSame, err = CheckHost(aZAPI, bZAPI, fHostGroup)
+            isSame, err = CheckHost(ctx, aZAPI, bZAPI, fHostGroup)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
@@ -328,7 +576,7 @@ func main() {
         }
 
         if checkType == "item" || checkType == "all" {
-            isSame, err = CheckItemGroup(aZAPI, bZAPI, fHostGroup)
+            isSame, err = CheckItemGroup(ctx, aZAPI, bZAPI, fHostGroup)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
@@ -343,7 +591,7 @@ func main() {
         }
 
         if checkType == "trigger" || checkType == "all" {
-            isSame, err = CheckTriggerNumGroup(aZAPI, bZAPI, fHostGroup)
+            isSame, err = CheckTriggerNumGroup(ctx, aZAPI, bZAPI, fHostGroup)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
@@ -358,7 +606,7 @@ func main() {
         }
 
         if checkType == "valuemap" || checkType == "all" {
-            isSame, err = CheckValuemap(aZAPI, bZAPI)
+            isSame, err = CheckValuemap(ctx, aZAPI, bZAPI)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
@@ -373,7 +621,7 @@ func main() {
         }
 
         if checkType == "map" || checkType == "all" {
-            isSame, err = CheckMap(aZAPI, bZAPI)
+            isSame, err = CheckMap(ctx, aZAPI, bZAPI)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
@@ -389,22 +637,128 @@ func main() {
     }
 
     if syncType != "" {
-        switch syncType {
-        case "trends":
-            err = SyncTrends(aZDB, bZDB, fHostGroup, fHostIdBegin, fIdOffset, fIgnore)
+        now := time.Now()
+        var window SyncWindow
+        window.From, err = ParseSyncTime(fFrom, now)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "sync.window",
+            }).Fatal(err)
+        }
+        window.To, err = ParseSyncTime(fTo, now)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "sync.window",
+            }).Fatal(err)
+        }
+        if fTo == "" && (syncType == "history" || syncType == "verify") && fFollow == 0 {
+            window.To = now.Unix() - 3600*24*int64(fDayOffset)
+        }
+
+        if syncType == "export" {
+            url, batch := fRWUrl, fRWBatch
+            if fExportFormat == ExportFormatInflux {
+                url, batch = fInfluxUrl, fInfluxBatch
+            }
+            if fExportFormat == ExportFormatParquet {
+                batch = fParquetRowGroup
+            }
+            newWriter, err := ExportWriterFor(aZDB, fExportFormat, fExportDir, int(fExportChunk), url, int(batch))
+            if err == nil {
+                err = ExportHistory(aZDB, fHostGroup, fHTable, fHostIdBegin, fIdOffset, window, newWriter)
+            }
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
-                    "step": "sync.trends",
-                }).Errorf("sync for trneds is error: %s", err)
+                    "step": "sync.export",
+                }).Errorf("sync for %s is error: %s", syncType, err)
             }
-        case "history":
-            err = SyncHistory(aZDB, bZDB, fHostGroup, fHTable, fHostIdBegin, fIdOffset, fDayOffset, fIgnore)
+            return
+        }
+
+        if syncType == "verify" {
+            count, err := VerifyHistory(aZDB, bZDB, fHostGroup, fHTable, fHostIdBegin, fIdOffset, window, fVerifyBucket, fVerifyReport, fIgnore)
+            if err != nil {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "sync.verify",
+                }).Errorf("sync for %s is error: %s", syncType, err)
+            } else if count > 0 {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "sync.verify",
+                }).Warnf("verify found %d discrepancies in window [%s]", count, window)
+            }
+            return
+        }
+
+        // a validate pass writes nothing, so it must not mark items as done
+        if fValidate {
+            bZDB.ValidateOnly = true
+            fCheckpoint = ""
+        }
+
+        err = bZDB.DetectTimescale()
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "sync.timescale",
+            }).Fatalf("detect timescaledb on new db get error: %s", err)
+        }
+        bZDB.TimescaleDecompress = fTSDBDecompress
+
+        var checkpoint *Checkpoint
+        if fFollow > 0 && fCheckpoint == "" {
+            log.WithFields(log.Fields{
+                "func": "main",
+                "step": "sync.follow",
+            }).Fatal("follow sync needs the checkpoint file for the last clock of items")
+        }
+
+        if fCheckpoint != "" {
+            cp, err := OpenCheckpoint(fCheckpoint, fResume, fFresh)
             if err != nil {
                 log.WithFields(log.Fields{
                     "func": "main",
-                    "step": "sync.history",
-                }).Errorf("sync for history is error: %s", err)
+                    "step": "sync.checkpoint",
+                }).Fatalf("open checkpoint file [%s] get error: %s", fCheckpoint, err)
+            }
+            defer cp.Close()
+            if w, ok := cp.Window(syncType); ok && fResume {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "sync.checkpoint",
+                }).Infof("resume with the time window [%s] of checkpoint", w)
+                window = w
+            }
+            err = cp.SaveWindow(syncType, window)
+            if err != nil {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "sync.checkpoint",
+                }).Fatal(err)
+            }
+            if aZDB != nil {
+                aZDB.Checkpoint = cp
+            }
+            checkpoint = cp
+        }
+
+        var pass func() error
+        switch syncType {
+        case "trends":
+            pass = func() error {
+                return SyncTrends(aZDB, bZDB, fHostGroup, fHostIdBegin, fIdOffset, window, fWorkers, fWorkUnit, fIgnore)
+            }
+        case "history":
+            pass = func() error {
+                return SyncHistory(aZDB, bZDB, fHostGroup, fHTable, fHostIdBegin, fIdOffset, window, fWorkers, fWorkUnit, fIgnore)
+            }
+        case "import":
+            pass = func() error {
+                return ImportHistory(bZDB, fExportDir, window, checkpoint, fIgnore)
             }
         default:
             log.WithFields(log.Fields{
@@ -412,6 +766,21 @@ func main() {
                 "step": "sync.default",
             }).Errorf("sync not support for %s", syncType)
         }
+
+        if pass != nil {
+            if fFollow > 0 {
+                aZDB.Follow = true
+                err = SyncFollow(fFollow, ctx.Done(), checkpoint, pass)
+            } else {
+                err = pass()
+            }
+            if err != nil {
+                log.WithFields(log.Fields{
+                    "func": "main",
+                    "step": "sync." + syncType,
+                }).Errorf("sync for %s is error: %s", syncType, err)
+            }
+        }
     }
 
 }
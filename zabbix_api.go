@@ -2,10 +2,20 @@ package main
 
 import (
     "bytes"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
     "encoding/json"
     "errors"
+    "fmt"
     "io"
+    "io/ioutil"
     "net/http"
+    "net/http/httptrace"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
 
     log "github.com/sirupsen/logrus"
@@ -16,15 +26,55 @@ const (
     JsonAuthID int = 112233
 )
 
+// ZabbixAPI can be shared by goroutines once logged in, the request id is
+// atomic and a relogin replaces the session under the lock.
 type ZabbixAPI struct {
     url         string
     user        string
     password    string
-    id          int
+    token       string
+    id          int64
+    mu          sync.RWMutex
     auth        string
+    Version     string
+    Retries     int
+    RetryWait   time.Duration
+    basicUser   string
+    basicPasswd string
     Client      *http.Client
 }
 
+const (
+    DefaultAPIRetries = 3
+    DefaultAPIRetryWait = DefaultRetryWait
+    DefaultAPITimeout = 150 * time.Second
+)
+
+// APITransport is the http of the frontend, like an internal CA, client
+// certificates, basic auth in front of it or a proxy on the way.
+type APITransport struct {
+    CAFile              string
+    CertFile            string
+    KeyFile             string
+    InsecureSkipVerify  bool
+    BasicUser           string
+    BasicPasswd         string
+    Proxy               string
+    Timeout             time.Duration
+}
+
+// the methods which are called without auth
+var noAuthMethods = map[string]bool{
+    "user.login": true,
+    "apiinfo.version": true,
+}
+
+// readOnlyMethod is a method which changes nothing when it is sent twice,
+// only these are retried after the request was sent.
+func readOnlyMethod(method string) bool {
+    return noAuthMethods[method] || strings.HasSuffix(method, ".get")
+}
+
 type JsonRPCRequsetBase struct {
     Jsonrpc     string      `json:"jsonrpc"`
     Method      string      `json:"method"`
@@ -51,6 +101,18 @@ type ZabbixAPIError struct {
     Code    int     `json:"code"`
     Message string  `json:"message"`
     Data    string  `json:"data"`
+    Method  string  `json:"-"`
+}
+
+func (e *ZabbixAPIError) Error() string {
+    return fmt.Sprintf("api %s error %d: %s %s", e.Method, e.Code, e.Message, e.Data)
+}
+
+// SessionTerminated reports whether the session of user.login is expired or
+// logged out, like after a restart of the frontend with sessions in memory.
+func (e *ZabbixAPIError) SessionTerminated() bool {
+    data := strings.ToLower(e.Data)
+    return strings.Contains(data, "re-login") || strings.Contains(data, "not authorised") || strings.Contains(data, "not authorized")
 }
 
 type ZUnitMap map[string]interface{}
@@ -73,29 +135,165 @@ func NewZabbixAPI(url, user, password string) (*ZabbixAPI, error) {
         user: user,
         password: password,
         auth: "",
-        id: JsonAuthID,
+        id: int64(JsonAuthID),
+        Retries: DefaultAPIRetries,
+        RetryWait: DefaultAPIRetryWait,
         Client: &http.Client{
-            Timeout: 150 * time.Second,
+            Timeout: DefaultAPITimeout,
         },
     }, nil
 }
 
-func (api *ZabbixAPI) Request(method string, params interface{}) (JsonRPCResponse, error) {
-    id := api.id
-    api.id = api.id + 1
+// SetTransport replaces the Client by one of the transport, the CA file is
+// trusted besides the system roots.
+func (api *ZabbixAPI) SetTransport(t APITransport) error {
+    tlsConfig := &tls.Config{
+        InsecureSkipVerify: t.InsecureSkipVerify,
+    }
+    if t.CAFile != "" {
+        pem, err := ioutil.ReadFile(t.CAFile)
+        if err != nil {
+            return err
+        }
+        pool, err := x509.SystemCertPool()
+        if err != nil || pool == nil {
+            pool = x509.NewCertPool()
+        }
+        if !pool.AppendCertsFromPEM(pem) {
+            return fmt.Errorf("no certificate found in ca file [%s]", t.CAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    if t.CertFile != "" || t.KeyFile != "" {
+        if t.CertFile == "" || t.KeyFile == "" {
+            return errors.New("client certificate needs both the cert file and the key file")
+        }
+        cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+        if err != nil {
+            return err
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = tlsConfig
+    if t.Proxy != "" {
+        proxy, err := url.Parse(t.Proxy)
+        if err != nil {
+            return fmt.Errorf("invalid proxy url [%s]: %s", t.Proxy, err)
+        }
+        transport.Proxy = http.ProxyURL(proxy)
+    }
+    timeout := t.Timeout
+    if timeout <= 0 {
+        timeout = DefaultAPITimeout
+    }
+
+    api.basicUser = t.BasicUser
+    api.basicPasswd = t.BasicPasswd
+    api.Client = &http.Client{
+        Transport: transport,
+        Timeout: timeout,
+    }
+    return nil
+}
+
+// SetToken makes the api use the token of zabbix 5.4 and later instead of
+// the session of user.login.
+func (api *ZabbixAPI) SetToken(token string) {
+    api.token = token
+}
+
+// AtLeast reports whether the api version detected by APIVersion is at least
+// major.minor.
+func (api *ZabbixAPI) AtLeast(major int, minor int) bool {
+    aMajor, aMinor, ok := parseVersion(api.Version)
+    if !ok {
+        return false
+    }
+    return aMajor > major || (aMajor == major && aMinor >= minor)
+}
+
+// headerAuth is the "Authorization: Bearer" header of zabbix 6.4, 7.0 does
+// not take the auth field any more. The header is taken by basic auth in
+// front of the frontend, then the auth field is kept before 7.0 and Login
+// refuses 7.0 and later.
+func (api *ZabbixAPI) headerAuth() bool {
+    return api.AtLeast(6, 4) && api.basicUser == ""
+}
+
+func (api *ZabbixAPI) session() string {
+    api.mu.RLock()
+    defer api.mu.RUnlock()
+    return api.auth
+}
+
+// relogin logs in again unless another goroutine has already replaced the
+// terminated session.
+func (api *ZabbixAPI) relogin(ctx context.Context, terminated string) error {
+    api.mu.Lock()
+    defer api.mu.Unlock()
+    if api.auth != terminated {
+        return nil
+    }
+    auth, err := api.login(ctx)
+    if err != nil {
+        return err
+    }
+    api.auth = auth
+    return nil
+}
+
+// Request calls the method, a failure of the transport or a retryStatus of a
+// readOnlyMethod is retried up to Retries times with backoff from RetryWait.
+// Other methods like configuration.import are only retried when they failed
+// before the request was written. A terminated session logs in again once,
+// an error of the api is a *ZabbixAPIError, the call is aborted when the ctx
+// is done.
+func (api *ZabbixAPI) Request(ctx context.Context, method string, params interface{}) (JsonRPCResponse, error) {
+    relogin := api.token == "" && !noAuthMethods[method] && method != "user.logout"
+    var res JsonRPCResponse
+    err := retryCall(ctx, fmt.Sprintf("request %s to api [%s]", method, api.url), api.Retries, api.RetryWait, func() (bool, error) {
+        // user.login is called by relogin under the lock of the session
+        auth := ""
+        if !noAuthMethods[method] {
+            auth = api.session()
+        }
+        var retry bool
+        var err error
+        res, retry, err = api.request(ctx, method, params, auth)
+        if apiErr, ok := err.(*ZabbixAPIError); ok && relogin && apiErr.SessionTerminated() {
+            relogin = false
+            log.WithFields(log.Fields{
+                "func": "ZabbixAPI.Request",
+                "step": "relogin",
+            }).Warnf("session of api [%s] is terminated, login again: %s", api.url, err)
+            err = api.relogin(ctx, auth)
+            if err != nil {
+                return false, err
+            }
+            res, retry, err = api.request(ctx, method, params, api.session())
+        }
+        return retry, err
+    })
+    return res, err
+}
+
+func (api *ZabbixAPI) request(ctx context.Context, method string, params interface{}, auth string) (JsonRPCResponse, bool, error) {
+    id := int(atomic.AddInt64(&api.id, 1) - 1)
     var err error
     var reqJson []byte
-    if method != "user.login" {
+    if !noAuthMethods[method] && !api.headerAuth() {
         reqObj := JsonRPCRequset{
             Jsonrpc: JsonrpcVersion,
             Method: method,
             Params: params,
-            Auth: api.auth,
+            Auth: auth,
             Id: id,
         }
         reqJson, err = json.Marshal(reqObj)
         if err != nil {
-            return JsonRPCResponse{}, err
+            return JsonRPCResponse{}, false, err
         }
     } else {
         reqObj := JsonRPCRequsetBase{
@@ -106,7 +304,7 @@ func (api *ZabbixAPI) Request(method string, params interface{}) (JsonRPCRespons
         }
         reqJson, err = json.Marshal(reqObj)
         if err != nil {
-            return JsonRPCResponse{}, err
+            return JsonRPCResponse{}, false, err
         }
     }
 
@@ -115,131 +313,219 @@ func (api *ZabbixAPI) Request(method string, params interface{}) (JsonRPCRespons
         "step": "request.json",
     }).Trace(string(reqJson))
 
-    req, err := http.NewRequest("POST", api.url, bytes.NewBuffer(reqJson))
+    // a request which is not written can not have been applied
+    var wrote int32
+    trace := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+        WroteRequest: func(httptrace.WroteRequestInfo) {
+            atomic.StoreInt32(&wrote, 1)
+        },
+    })
+    req, err := http.NewRequestWithContext(trace, "POST", api.url, bytes.NewBuffer(reqJson))
     if err != nil {
-        return JsonRPCResponse{}, err
+        return JsonRPCResponse{}, false, err
     }
     req.Header.Add("Content-Type", "application/json-rpc")
+    if api.basicUser != "" {
+        req.SetBasicAuth(api.basicUser, api.basicPasswd)
+    }
+    if !noAuthMethods[method] && api.headerAuth() && auth != "" {
+        req.Header.Set("Authorization", "Bearer "+auth)
+    }
 
+    readOnly := readOnlyMethod(method)
     rsp, err := api.Client.Do(req)
     if err != nil {
-        return JsonRPCResponse{}, err
+        return JsonRPCResponse{}, readOnly || atomic.LoadInt32(&wrote) == 0, err
     }
+    defer rsp.Body.Close()
 
-    var res JsonRPCResponse
     var buf bytes.Buffer
     _, err = io.Copy(&buf, rsp.Body)
     if err != nil {
-        return JsonRPCResponse{}, err
+        return JsonRPCResponse{}, readOnly, err
+    }
+    if rsp.StatusCode/100 != 2 {
+        return JsonRPCResponse{}, readOnly && retryStatus(rsp.StatusCode), fmt.Errorf("api %s get http status %s", method, rsp.Status)
     }
-    json.Unmarshal(buf.Bytes(), &res)
 
-    rsp.Body.Close()
+    var res JsonRPCResponse
+    err = json.Unmarshal(buf.Bytes(), &res)
+    if err != nil {
+        return JsonRPCResponse{}, false, fmt.Errorf("api %s get invalid response: %s", method, err)
+    }
 
     log.WithFields(log.Fields{
         "func": "ZabbixAPI.Request",
         "step": "response.result",
     }).Trace(res)
 
-    return res, nil
+    if res.Error.Code != 0 {
+        apiErr := res.Error
+        apiErr.Method = method
+        return res, false, &apiErr
+    }
+    return res, false, nil
 }
 
-func (api *ZabbixAPI) Login() (bool, error) {
-    params := make(map[string]string, 0)
-    params["user"] = api.user
-    params["password"] = api.password
+// APIVersion detects the version of the api by apiinfo.version.
+func (api *ZabbixAPI) APIVersion(ctx context.Context) (string, error) {
+    rsp, err := api.Request(ctx, "apiinfo.version", []string{})
+    if err != nil {
+        return "", err
+    }
+    version, ok := rsp.Result.(string)
+    if !ok {
+        return "", fmt.Errorf("unexpected apiinfo.version result %v", rsp.Result)
+    }
+    api.Version = version
+    return version, nil
+}
 
-    rsp, err := api.Request("user.login", params)
+// Login detects the version of the api and takes the token when it is set,
+// else it logs in with "username" of zabbix 5.4 and later or "user" before.
+// An api of an unknown version is refused like by CheckVersionPair, since
+// the login and the auth depend on it.
+// It is called before the api is shared by goroutines.
+func (api *ZabbixAPI) Login(ctx context.Context) (bool, error) {
+    if api.Version == "" {
+        _, err := api.APIVersion(ctx)
+        if err != nil {
+            return false, fmt.Errorf("detect api version of [%s] get error: %s", api.url, err)
+        }
+    }
+    if _, _, ok := parseVersion(api.Version); !ok {
+        return false, fmt.Errorf("unknown api version [%s] of [%s]", api.Version, api.url)
+    }
+    if api.basicUser != "" && api.AtLeast(7, 0) {
+        return false, fmt.Errorf("api [%s] of zabbix %s only takes the session or token in the Authorization header, which is taken by basic auth, remove api_basic_user or the basic auth in front of the frontend", api.url, api.Version)
+    }
+    auth, err := api.login(ctx)
     if err != nil {
         return false, err
     }
-    if rsp.Error.Code != 0 {
-        return false, errors.New(rsp.Error.Data)
+    api.mu.Lock()
+    api.auth = auth
+    api.mu.Unlock()
+    return true, nil
+}
+
+func (api *ZabbixAPI) login(ctx context.Context) (string, error) {
+    if api.token != "" {
+        return api.token, nil
+    }
+
+    params := make(map[string]string, 0)
+    if api.AtLeast(5, 4) {
+        params["username"] = api.user
+    } else {
+        params["user"] = api.user
     }
+    params["password"] = api.password
 
-    api.auth = rsp.Result.(string)
-    return true, nil
+    rsp, err := api.Request(ctx, "user.login", params)
+    if err != nil {
+        return "", err
+    }
+    auth, ok := rsp.Result.(string)
+    if !ok {
+        return "", fmt.Errorf("unexpected user.login result %v", rsp.Result)
+    }
+    return auth, nil
 }
 
-func (api *ZabbixAPI) Logout() (bool, error) {
+func (api *ZabbixAPI) Logout(ctx context.Context) (bool, error) {
+    // a token is not a session of user.login
+    if api.token != "" {
+        return true, nil
+    }
     params := make(map[string]string, 0)
-    rsp, err := api.Request("user.logout", params)
+    _, err := api.Request(ctx, "user.logout", params)
     if err != nil {
         return false, err
     }
-    if rsp.Error.Code != 0 {
-        return false, errors.New(rsp.Error.Data)
-    }
 
     return true, nil
 }
 
-func (api *ZabbixAPI) Host(method string, params interface{}) ([]ZUnitMap, error) {
-    rsp, err := api.Request("host."+method, params)
+func (api *ZabbixAPI) Host(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "host."+method, params)
     if err != nil {
         return nil, err
     }
-    if rsp.Error.Code != 0 {
-        return nil, errors.New(rsp.Error.Data)
-    }
 
     res, err := json.Marshal(rsp.Result)
     var ret []ZUnitMap
     err = json.Unmarshal(res, &ret)
+    if err != nil {
+        return nil, err
+    }
+
     return ret, nil
 }
 
-func (api *ZabbixAPI) HostGroup(method string, params interface{}) ([]ZUnitMap, error) {
-    rsp, err := api.Request("hostgroup."+method, params)
+func (api *ZabbixAPI) HostGroup(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "hostgroup."+method, params)
     if err != nil {
         return nil, err
     }
-    if rsp.Error.Code != 0 {
-        return nil, errors.New(rsp.Error.Data)
-    }
 
     res, err := json.Marshal(rsp.Result)
     var ret []ZUnitMap
     err = json.Unmarshal(res, &ret)
+    if err != nil {
+        return nil, err
+    }
+
     return ret, nil
 }
 
-func (api *ZabbixAPI) Template(method string, params interface{}) ([]ZUnitMap, error) {
-    rsp, err := api.Request("template."+method, params)
+func (api *ZabbixAPI) TemplateGroup(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "templategroup."+method, params)
     if err != nil {
         return nil, err
     }
-    if rsp.Error.Code != 0 {
-        return nil, errors.New(rsp.Error.Data)
+
+    res, err := json.Marshal(rsp.Result)
+    var ret []ZUnitMap
+    err = json.Unmarshal(res, &ret)
+    if err != nil {
+        return nil, err
+    }
+
+    return ret, nil
+}
+
+func (api *ZabbixAPI) Template(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "template."+method, params)
+    if err != nil {
+        return nil, err
     }
 
     res, err := json.Marshal(rsp.Result)
     var ret []ZUnitMap
     err = json.Unmarshal(res, &ret)
+    if err != nil {
+        return nil, err
+    }
+
     return ret, nil
 }
 
-func (api *ZabbixAPI) Configuration(method string, params interface{}) (interface{}, error) {
-    rsp, err := api.Request("configuration."+method, params)
+func (api *ZabbixAPI) Configuration(ctx context.Context, method string, params interface{}) (interface{}, error) {
+    rsp, err := api.Request(ctx, "configuration."+method, params)
     if err != nil {
         return "", err
     }
-    if rsp.Error.Code != 0 {
-        return "", errors.New(rsp.Error.Data)
-    }
 
     res := rsp.Result
     return res, nil
 }
 
-func (api *ZabbixAPI) Valuemap(method string, params interface{}) ([]ZUnitMap, error) {
-    rsp, err := api.Request("valuemap."+method, params)
+func (api *ZabbixAPI) Valuemap(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "valuemap."+method, params)
     if err != nil {
         return nil, err
     }
-    if rsp.Error.Code != 0 {
-        return nil, errors.New(rsp.Error.Data)
-    }
 
     res, err := json.Marshal(rsp.Result)
     var ret []ZUnitMap
@@ -251,14 +537,11 @@ func (api *ZabbixAPI) Valuemap(method string, params interface{}) ([]ZUnitMap, e
     return ret, nil
 }
 
-func (api *ZabbixAPI) Item(method string, params interface{}) ([]ZUnitMap, error) {
-    rsp, err := api.Request("item."+method, params)
+func (api *ZabbixAPI) Item(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "item."+method, params)
     if err != nil {
         return nil, err
     }
-    if rsp.Error.Code != 0 {
-        return nil, errors.New(rsp.Error.Data)
-    }
 
     res, err := json.Marshal(rsp.Result)
     var ret []ZUnitMap
@@ -270,14 +553,11 @@ func (api *ZabbixAPI) Item(method string, params interface{}) ([]ZUnitMap, error
     return ret, nil
 }
 
-func (api *ZabbixAPI) Trigger(method string, params interface{}) ([]ZUnitMap, error) {
-    rsp, err := api.Request("trigger."+method, params)
+func (api *ZabbixAPI) Trigger(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "trigger."+method, params)
     if err != nil {
         return nil, err
     }
-    if rsp.Error.Code != 0 {
-        return nil, errors.New(rsp.Error.Data)
-    }
 
     res, err := json.Marshal(rsp.Result)
     var ret []ZUnitMap
@@ -289,14 +569,11 @@ func (api *ZabbixAPI) Trigger(method string, params interface{}) ([]ZUnitMap, er
     return ret, nil
 }
 
-func (api *ZabbixAPI) Hostprototype(method string, params interface{}) ([]ZUnitMap, error) {
-    rsp, err := api.Request("hostprototype."+method, params)
+func (api *ZabbixAPI) Hostprototype(ctx context.Context, method string, params interface{}) ([]ZUnitMap, error) {
+    rsp, err := api.Request(ctx, "hostprototype."+method, params)
     if err != nil {
         return nil, err
     }
-    if rsp.Error.Code != 0 {
-        return nil, errors.New(rsp.Error.Data)
-    }
 
     res, err := json.Marshal(rsp.Result)
     var ret []ZUnitMap
@@ -306,4 +583,41 @@ func (api *ZabbixAPI) Hostprototype(method string, params interface{}) ([]ZUnitM
     }
 
     return ret, nil
-}
\ No newline at end of file
+}
+
+func (api *ZabbixAPI) Task(ctx context.Context, method string, params interface{}) (interface{}, error) {
+    rsp, err := api.Request(ctx, "task."+method, params)
+    if err != nil {
+        return nil, err
+    }
+
+    return rsp.Result, nil
+}
+
+// CheckNow asks the server to execute the items or discovery rules at once,
+// the request form of zabbix 5.2 is tried before the one of 4.x to 5.0.
+func (api *ZabbixAPI) CheckNow(ctx context.Context, itemids []int) error {
+    if len(itemids) == 0 {
+        return nil
+    }
+
+    tasks := make([]map[string]interface{}, len(itemids))
+    for idx, itemid := range itemids {
+        tasks[idx] = map[string]interface{}{
+            "type": 6,
+            "request": map[string]interface{}{
+                "itemid": itemid,
+            },
+        }
+    }
+    _, err := api.Task(ctx, "create", tasks)
+    if err == nil {
+        return nil
+    }
+
+    params := make(map[string]interface{}, 0)
+    params["type"] = 6
+    params["itemids"] = itemids
+    _, err = api.Task(ctx, "create", params)
+    return err
+}
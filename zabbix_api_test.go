@@ -1,8 +1,19 @@
 package main
 
 import (
-    "testing"
+    "context"
+    "encoding/json"
+    "encoding/pem"
+    "io/ioutil"
     "log"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
 )
 
 func TestZabbixAPI(t *testing.T) {
@@ -11,7 +22,7 @@ func TestZabbixAPI(t *testing.T) {
         "Admin",
         "zabbix",
     )
-    _, err := api.Login()
+    _, err := api.Login(context.Background())
     if err != nil {
         log.Println(err)
     }
@@ -21,7 +32,7 @@ func TestZabbixAPI(t *testing.T) {
     params["output"] = "extend"
     filter["name"] = []string{"Linux servers", "Zabbix servers"}
     params["filter"] = filter
-    res, err := api.HostGroup("get", params)
+    res, err := api.HostGroup(context.Background(), "get", params)
     if err != nil {
         log.Println(err)
     }
@@ -40,10 +51,10 @@ func TestHGCreate(t *testing.T) {
         "zabbix",
     )
 
-    aAPI.Login()
-    bAPI.Login()
+    aAPI.Login(context.Background())
+    bAPI.Login(context.Background())
 
-    err := CreateNewHostGroup(aAPI, bAPI)
+    err := CreateNewHostGroup(context.Background(), aAPI, bAPI)
     if err != nil {
         log.Println(err)
     }
@@ -55,7 +66,7 @@ func TestGetHost(t *testing.T) {
         "Admin",
         "zabbix",
     )
-    _, err := api.Login()
+    _, err := api.Login(context.Background())
     if err != nil {
         log.Println(err)
     }
@@ -63,7 +74,7 @@ func TestGetHost(t *testing.T) {
     filter := make(map[string][]string, 0)
     filter["status"] = []string{"0"}
     params["filter"] = filter
-    res, err := api.Host("get", params)
+    res, err := api.Host(context.Background(), "get", params)
     if err != nil {
         log.Println(err)
     }
@@ -77,7 +88,7 @@ func TestTemplate(t *testing.T) {
         "Admin",
         "zabbix",
     )
-    _, err := api.Login()
+    _, err := api.Login(context.Background())
     if err != nil {
         log.Println(err)
     }
@@ -86,7 +97,7 @@ func TestTemplate(t *testing.T) {
     filter["host"] = []string{"Template OS Linux"}
     params["filter"] = filter
     params["output"] = "extend"
-    res, err := api.Template("get", params)
+    res, err := api.Template(context.Background(), "get", params)
     if err != nil {
         log.Println(err)
     }
@@ -99,7 +110,7 @@ func TestConfiguration(t *testing.T) {
         "Admin",
         "zabbix",
     )
-    _, err := api.Login()
+    _, err := api.Login(context.Background())
     if err != nil {
         log.Println(err)
     }
@@ -108,7 +119,7 @@ func TestConfiguration(t *testing.T) {
     options["templates"] = []string{"10225", "10226"}
     params["options"] = options
     params["format"] = "xml"
-    res, err := api.Configuration("export", params)
+    res, err := api.Configuration(context.Background(), "export", params)
     if err != nil {
         log.Println(err)
     }
@@ -134,4 +145,312 @@ func TestFilterMapList(t *testing.T) {
 
     }
     log.Println(a)
-}
\ No newline at end of file
+}
+
+// fakeZabbixAPI answers apiinfo.version with the version, user.login with the
+// session and other methods with the auth they were called with.
+func fakeZabbixAPI(t *testing.T, version string) *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req map[string]interface{}
+        json.NewDecoder(r.Body).Decode(&req)
+        _, hasAuth := req["auth"]
+        res := map[string]interface{}{"jsonrpc": "2.0", "id": req["id"]}
+        switch req["method"] {
+        case "apiinfo.version":
+            if hasAuth || r.Header.Get("Authorization") != "" {
+                t.Error("apiinfo.version is called with auth")
+            }
+            res["result"] = version
+        case "user.login":
+            params := req["params"].(map[string]interface{})
+            if _, ok := params["username"]; !ok && version >= "5.4" {
+                t.Errorf("user.login of %s without username: %v", version, params)
+            }
+            res["result"] = "session"
+        default:
+            auth := r.Header.Get("Authorization")
+            if hasAuth {
+                auth = "auth " + req["auth"].(string)
+            }
+            res["result"] = auth
+        }
+        json.NewEncoder(w).Encode(res)
+    }))
+}
+
+func TestAPIAuth(t *testing.T) {
+    cases := []struct {
+        version string
+        token   string
+        want    string
+    }{
+        {"4.0.30", "", "auth session"},
+        {"5.4.0", "", "auth session"},
+        {"6.0.0", "abcd", "auth abcd"},
+        {"6.4.0", "", "Bearer session"},
+        {"7.0.0", "abcd", "Bearer abcd"},
+    }
+    for _, c := range cases {
+        srv := fakeZabbixAPI(t, c.version)
+        api, _ := NewZabbixAPI(srv.URL, "Admin", "zabbix")
+        api.SetToken(c.token)
+        if _, err := api.Login(context.Background()); err != nil {
+            t.Fatal(err)
+        }
+        if api.Version != c.version {
+            t.Errorf("version = %s, want %s", api.Version, c.version)
+        }
+        rsp, err := api.Request(context.Background(), "host.get", map[string]interface{}{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if rsp.Result != c.want {
+            t.Errorf("%s auth = %v, want %s", c.version, rsp.Result, c.want)
+        }
+        srv.Close()
+    }
+}
+
+func TestAPIUnknownVersion(t *testing.T) {
+    srv := fakeZabbixAPI(t, "trunk")
+    defer srv.Close()
+    api, _ := NewZabbixAPI(srv.URL, "Admin", "zabbix")
+    if _, err := api.Login(context.Background()); err == nil {
+        t.Error("login with unknown version is accepted")
+    }
+
+    down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNotFound)
+    }))
+    defer down.Close()
+    api, _ = NewZabbixAPI(down.URL, "Admin", "zabbix")
+    if _, err := api.Login(context.Background()); err == nil {
+        t.Error("login without apiinfo.version is accepted")
+    }
+}
+
+func TestAPIRetry(t *testing.T) {
+    var logins, fails int
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req map[string]interface{}
+        json.NewDecoder(r.Body).Decode(&req)
+        res := map[string]interface{}{"jsonrpc": "2.0", "id": req["id"]}
+        switch req["method"] {
+        case "apiinfo.version":
+            res["result"] = "5.0.1"
+        case "user.login":
+            logins++
+            res["result"] = "session" + string(rune('0'+logins))
+        case "host.get":
+            // the web server restarts with the sessions lost
+            if fails < 1 {
+                fails++
+                w.WriteHeader(http.StatusBadGateway)
+                return
+            }
+            if req["auth"] == "session1" {
+                res["error"] = map[string]interface{}{"code": -32602, "message": "Invalid params.", "data": "Session terminated, re-login, please."}
+                break
+            }
+            res["result"] = []interface{}{map[string]interface{}{"hostid": "1"}}
+        case "item.get":
+            res["error"] = map[string]interface{}{"code": -32500, "message": "Application error.", "data": "No permissions."}
+        default:
+            w.Write([]byte("<html>"))
+            return
+        }
+        json.NewEncoder(w).Encode(res)
+    }))
+    defer srv.Close()
+
+    api, _ := NewZabbixAPI(srv.URL, "Admin", "zabbix")
+    api.RetryWait = time.Millisecond
+    if _, err := api.Login(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    hosts, err := api.Host(context.Background(), "get", map[string]interface{}{})
+    if err != nil || len(hosts) != 1 || logins != 2 {
+        t.Errorf("hosts = %v, logins = %d, err = %v", hosts, logins, err)
+    }
+
+    _, err = api.Item(context.Background(), "get", map[string]interface{}{})
+    apiErr, ok := err.(*ZabbixAPIError)
+    if !ok || apiErr.Code != -32500 || apiErr.Method != "item.get" || apiErr.Data != "No permissions." {
+        t.Errorf("item.get err = %#v", err)
+    }
+    if _, err = api.Trigger(context.Background(), "get", map[string]interface{}{}); err == nil {
+        t.Error("invalid response is accepted")
+    }
+}
+
+func TestAPIRetryWrite(t *testing.T) {
+    var imports int
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req map[string]interface{}
+        json.NewDecoder(r.Body).Decode(&req)
+        res := map[string]interface{}{"jsonrpc": "2.0", "id": req["id"]}
+        switch req["method"] {
+        case "apiinfo.version":
+            res["result"] = "6.0.0"
+        case "user.login":
+            res["result"] = "session"
+        case "configuration.import":
+            // the proxy times out while the import goes on
+            imports++
+            w.WriteHeader(http.StatusBadGateway)
+            return
+        }
+        json.NewEncoder(w).Encode(res)
+    }))
+
+    api, _ := NewZabbixAPI(srv.URL, "Admin", "zabbix")
+    api.RetryWait = time.Millisecond
+    if _, err := api.Login(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := api.Request(context.Background(), "configuration.import", map[string]interface{}{}); err == nil || imports != 1 {
+        t.Errorf("configuration.import is sent %d times, err = %v", imports, err)
+    }
+
+    // a refused connection has not sent the request
+    srv.Close()
+    if _, retry, err := api.request(context.Background(), "host.create", map[string]interface{}{}, "session"); err == nil || !retry {
+        t.Errorf("unsent host.create retry = %v, err = %v", retry, err)
+    }
+    for _, c := range []struct {
+        method string
+        want   bool
+    }{
+        {"host.get", true},
+        {"apiinfo.version", true},
+        {"user.login", true},
+        {"host.create", false},
+        {"task.create", false},
+        {"configuration.import", false},
+    } {
+        if readOnlyMethod(c.method) != c.want {
+            t.Errorf("readOnlyMethod(%s) = %v", c.method, !c.want)
+        }
+    }
+}
+
+func TestAPITransport(t *testing.T) {
+    version := "6.4.0"
+    srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req map[string]interface{}
+        json.NewDecoder(r.Body).Decode(&req)
+        user, passwd, ok := r.BasicAuth()
+        if !ok || user != "proxyuser" || passwd != "secret" {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        res := map[string]interface{}{"jsonrpc": "2.0", "id": req["id"], "result": version}
+        if req["method"] == "host.get" {
+            // the auth stays in the body, the header is taken by basic auth
+            res["result"] = req["auth"]
+        }
+        json.NewEncoder(w).Encode(res)
+    }))
+    defer srv.Close()
+
+    dir, err := ioutil.TempDir("", "api")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    caFile := filepath.Join(dir, "ca.pem")
+    ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+    api, _ := NewZabbixAPI(srv.URL, "Admin", "zabbix")
+    api.Retries = 0
+    if _, err := api.APIVersion(context.Background()); err == nil {
+        t.Error("certificate of unknown ca is accepted")
+    }
+
+    transport := APITransport{CAFile: caFile, BasicUser: "proxyuser", BasicPasswd: "secret", Timeout: 5 * time.Second}
+    if err := api.SetTransport(transport); err != nil {
+        t.Fatal(err)
+    }
+    api.SetToken("abcd")
+    if _, err := api.Login(context.Background()); err != nil || api.Version != "6.4.0" {
+        t.Fatalf("version = %s, err = %v", api.Version, err)
+    }
+    rsp, err := api.Request(context.Background(), "host.get", map[string]interface{}{})
+    if err != nil || rsp.Result != "abcd" {
+        t.Errorf("result = %v, err = %v", rsp.Result, err)
+    }
+
+    // 7.0 only takes the Authorization header
+    version = "7.0.0"
+    api.Version = ""
+    if _, err := api.Login(context.Background()); err == nil || !strings.Contains(err.Error(), "basic auth") {
+        t.Errorf("basic auth with 7.0 get error: %v", err)
+    }
+
+    if err := api.SetTransport(APITransport{InsecureSkipVerify: true}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := api.APIVersion(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+        t.Errorf("request without basic auth get error: %v", err)
+    }
+    if err := api.SetTransport(APITransport{CertFile: caFile}); err == nil {
+        t.Error("client certificate without key file is accepted")
+    }
+}
+
+func TestAPIConcurrent(t *testing.T) {
+    var mu sync.Mutex
+    ids := make(map[float64]bool)
+    block := make(chan struct{})
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var req map[string]interface{}
+        json.NewDecoder(r.Body).Decode(&req)
+        mu.Lock()
+        if ids[req["id"].(float64)] {
+            t.Errorf("request id %v is used twice", req["id"])
+        }
+        ids[req["id"].(float64)] = true
+        mu.Unlock()
+        res := map[string]interface{}{"jsonrpc": "2.0", "id": req["id"]}
+        switch req["method"] {
+        case "apiinfo.version":
+            res["result"] = "6.0.0"
+        case "user.login":
+            res["result"] = "session"
+        case "item.get":
+            <-block
+            res["result"] = []interface{}{}
+        default:
+            res["result"] = []interface{}{map[string]interface{}{"hostid": "1"}}
+        }
+        json.NewEncoder(w).Encode(res)
+    }))
+    defer srv.Close()
+    defer close(block)
+
+    api, _ := NewZabbixAPI(srv.URL, "Admin", "zabbix")
+    if _, err := api.Login(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := api.Host(context.Background(), "get", map[string]interface{}{}); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+    if len(ids) != 22 {
+        t.Errorf("got %d request ids, want 22", len(ids))
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    _, err := api.Item(ctx, "get", map[string]interface{}{})
+    if ctx.Err() == nil || err == nil {
+        t.Errorf("item.get is not aborted by the context, err = %v", err)
+    }
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "bytes"
+    "database/sql"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "sync/atomic"
+
+    "github.com/go-sql-driver/mysql"
+    "github.com/lib/pq"
+)
+
+var (
+    HistoryColumns = []string{"itemid", "clock", "value", "ns"}
+    HistoryLogColumns = []string{"itemid", "clock", "timestamp", "source", "severity", "value", "logeventid", "ns"}
+)
+
+var bulkReaderSeq uint64
+
+var mysqlInfileReplacer = strings.NewReplacer(
+    "\\", "\\\\",
+    "\t", "\\t",
+    "\n", "\\n",
+    "\r", "\\r",
+    "\x00", "\\0",
+)
+
+func HistoryTableColumns(hTable string) []string {
+    if hTable == "history_log" {
+        return HistoryLogColumns
+    }
+    return HistoryColumns
+}
+
+// LoadRows streams rows into the table by the native bulk path of the driver,
+// COPY FROM STDIN for postgres and LOAD DATA LOCAL INFILE for mysql. The rows
+// are written all or nothing in a transaction, so the caller can fall back to
+// InsertRows. LOAD DATA LOCAL skips duplicate or truncates invalid rows with
+// warnings, they are taken as a failure of the load.
+func (db *ZabbixDB) LoadRows(table string, columns []string, rows [][]interface{}) error {
+    switch db.DBDriver {
+    case "mysql":
+        return db.loadRowsMysql(table, columns, rows)
+    case "postgres":
+        return db.loadRowsPostgres(table, columns, rows)
+    }
+    return errors.New("cannot support bulk load for the db driver")
+}
+
+func (db *ZabbixDB) loadRowsPostgres(table string, columns []string, rows [][]interface{}) error {
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return err
+    }
+    stmt, err := tx.Prepare(pq.CopyIn(table, columns...))
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    for _, row := range rows {
+        _, err = stmt.Exec(row...)
+        if err != nil {
+            stmt.Close()
+            tx.Rollback()
+            return err
+        }
+    }
+    _, err = stmt.Exec()
+    if err != nil {
+        stmt.Close()
+        tx.Rollback()
+        return err
+    }
+    err = stmt.Close()
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+func (db *ZabbixDB) loadRowsMysql(table string, columns []string, rows [][]interface{}) error {
+    var buf bytes.Buffer
+    WriteInfileRows(&buf, rows)
+
+    name := fmt.Sprintf("zabbix_migrate_%d", atomic.AddUint64(&bulkReaderSeq, 1))
+    mysql.RegisterReaderHandler(name, func() io.Reader {
+        return &buf
+    })
+    defer mysql.DeregisterReaderHandler(name)
+
+    // warnings and the rolled back rows need the same connection
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return err
+    }
+    res, err := tx.Exec(fmt.Sprintf(
+        "load data local infile 'Reader::%s' into table %s character set utf8mb4 (%s)",
+        name,
+        table,
+        strings.Join(columns, ", "),
+    ))
+    if err == nil {
+        err = checkInfileResult(tx, res, len(rows))
+    }
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+// checkInfileResult fails when LOAD DATA LOCAL has not written every row as
+// it is, the first warning is returned.
+func checkInfileResult(tx *sql.Tx, res sql.Result, rows int) error {
+    affected, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    wRows, err := tx.Query("show warnings")
+    if err != nil {
+        return err
+    }
+    defer wRows.Close()
+    warnings := 0
+    var first string
+    for wRows.Next() {
+        var level, message string
+        var code int
+        err = wRows.Scan(&level, &code, &message)
+        if err != nil {
+            return err
+        }
+        if warnings == 0 {
+            first = fmt.Sprintf("%s %d: %s", level, code, message)
+        }
+        warnings++
+    }
+    err = wRows.Err()
+    if err != nil {
+        return err
+    }
+    if warnings > 0 {
+        return fmt.Errorf("load data loaded %d of %d rows with %d warnings, first %s", affected, rows, warnings, first)
+    }
+    if affected != int64(rows) {
+        return fmt.Errorf("load data loaded %d of %d rows", affected, rows)
+    }
+    return nil
+}
+
+// WriteInfileRows encodes rows in the default tab separated format of
+// LOAD DATA, escaping the separators inside of the values.
+func WriteInfileRows(w io.Writer, rows [][]interface{}) {
+    for _, row := range rows {
+        for idx, val := range row {
+            if idx > 0 {
+                io.WriteString(w, "\t")
+            }
+            if val == nil {
+                io.WriteString(w, "\\N")
+                continue
+            }
+            io.WriteString(w, mysqlInfileReplacer.Replace(fmt.Sprint(val)))
+        }
+        io.WriteString(w, "\n")
+    }
+}
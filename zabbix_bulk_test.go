@@ -0,0 +1,19 @@
+package main
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestWriteInfileRows(t *testing.T) {
+    var buf bytes.Buffer
+    rows := [][]interface{}{
+        []interface{}{10, 1600000000, "a\tb\\c\nd", 5},
+        []interface{}{11, 1600000001, nil, 6},
+    }
+    WriteInfileRows(&buf, rows)
+    expect := "10\t1600000000\ta\\tb\\\\c\\nd\t5\n11\t1600000001\t\\N\t6\n"
+    if buf.String() != expect {
+        t.Fatalf("unexpected infile rows: %q", buf.String())
+    }
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+    "sync"
+)
+
+// CheckpointEntry is the progress of one item of one table in one sync window,
+// an entry with a zero Itemid marks the whole host of the table as done.
+type CheckpointEntry struct {
+    Table   string  `json:"table"`
+    From    int64   `json:"from"`
+    To      int64   `json:"to"`
+    Hostid  int     `json:"hostid"`
+    Itemid  int     `json:"itemid"`
+    Clock   int     `json:"clock"`
+    Ns      int     `json:"ns"`
+    Done    bool    `json:"done"`
+}
+
+// Checkpoint keeps the sync progress in a local file of json lines. Every
+// update is appended as one line and the last line of a key wins on load, so
+// a run killed at any moment loses nothing but the page in flight.
+type Checkpoint struct {
+    path    string
+    mu      sync.Mutex
+    file    *os.File
+    entries map[string]CheckpointEntry
+}
+
+func NewCheckpointEntry(table string, window SyncWindow, hostid int, itemid int, clock int, ns int, done bool) CheckpointEntry {
+    return CheckpointEntry{
+        Table: table,
+        From: window.From,
+        To: window.To,
+        Hostid: hostid,
+        Itemid: itemid,
+        Clock: clock,
+        Ns: ns,
+        Done: done,
+    }
+}
+
+func (e CheckpointEntry) Window() SyncWindow {
+    return SyncWindow{From: e.From, To: e.To}
+}
+
+func checkpointKey(table string, window SyncWindow, hostid int, itemid int) string {
+    if itemid != 0 {
+        return fmt.Sprintf("%s:%s:item:%d", table, window, itemid)
+    }
+    return fmt.Sprintf("%s:%s:host:%d", table, window, hostid)
+}
+
+// the window of a run is saved under the kind of sync alone, relative bounds
+// like -d or 90d move with the clock and would not match on resume
+func (e CheckpointEntry) key() string {
+    if strings.HasPrefix(e.Table, "window:") {
+        return e.Table
+    }
+    return checkpointKey(e.Table, e.Window(), e.Hostid, e.Itemid)
+}
+
+// OpenCheckpoint opens the checkpoint file, with resume the recorded progress
+// is loaded and compacted, with fresh the file is started over. A file with
+// progress is refused without one of them, a plain rerun must not wipe it.
+func OpenCheckpoint(path string, resume bool, fresh bool) (*Checkpoint, error) {
+    cp := &Checkpoint{
+        path: path,
+        entries: make(map[string]CheckpointEntry),
+    }
+
+    if !fresh {
+        err := cp.load()
+        if err != nil {
+            return nil, err
+        }
+    }
+    if !resume && len(cp.entries) > 0 {
+        return nil, fmt.Errorf("checkpoint file [%s] has the progress of %d items and hosts, set -resume to go on or -fresh to start over", path, len(cp.entries))
+    }
+
+    err := cp.rewrite()
+    if err != nil {
+        return nil, err
+    }
+    return cp, nil
+}
+
+// rewrite writes the entries to a new file which replaces the old one, so
+// the file keeps one line per key.
+func (cp *Checkpoint) rewrite() error {
+    var buf bytes.Buffer
+    for _, entry := range cp.entries {
+        line, err := json.Marshal(entry)
+        if err != nil {
+            return err
+        }
+        buf.Write(append(line, '\n'))
+    }
+
+    if cp.file != nil {
+        cp.file.Close()
+        cp.file = nil
+    }
+    tmp := cp.path + ".tmp"
+    err := ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+    if err != nil {
+        return err
+    }
+    err = os.Rename(tmp, cp.path)
+    if err != nil {
+        return err
+    }
+    cp.file, err = os.OpenFile(cp.path, os.O_WRONLY|os.O_APPEND, 0644)
+    return err
+}
+
+// Compact drops the lines overwritten by later ones, like in follow mode
+// where every pass appends the new last clock of the items.
+func (cp *Checkpoint) Compact() error {
+    cp.mu.Lock()
+    defer cp.mu.Unlock()
+    return cp.rewrite()
+}
+
+func (cp *Checkpoint) load() error {
+    file, err := os.Open(cp.path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var entry CheckpointEntry
+        // the last line may be cut by a crash, skip what can not be parsed
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            continue
+        }
+        cp.entries[entry.key()] = entry
+    }
+    return scanner.Err()
+}
+
+func (cp *Checkpoint) write(entry CheckpointEntry) error {
+    line, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    _, err = cp.file.Write(append(line, '\n'))
+    return err
+}
+
+func (cp *Checkpoint) Close() error {
+    cp.mu.Lock()
+    defer cp.mu.Unlock()
+    return cp.file.Close()
+}
+
+func (cp *Checkpoint) Item(table string, window SyncWindow, itemid int) (CheckpointEntry, bool) {
+    cp.mu.Lock()
+    defer cp.mu.Unlock()
+    entry, ok := cp.entries[checkpointKey(table, window, 0, itemid)]
+    return entry, ok
+}
+
+// Host returns the entry of the host, like the count of records written of
+// an import file in Clock.
+func (cp *Checkpoint) Host(table string, window SyncWindow, hostid int) (CheckpointEntry, bool) {
+    cp.mu.Lock()
+    defer cp.mu.Unlock()
+    entry, ok := cp.entries[checkpointKey(table, window, hostid, 0)]
+    return entry, ok
+}
+
+func (cp *Checkpoint) HostDone(table string, window SyncWindow, hostid int) bool {
+    cp.mu.Lock()
+    defer cp.mu.Unlock()
+    entry, ok := cp.entries[checkpointKey(table, window, hostid, 0)]
+    return ok && entry.Done
+}
+
+// Save records the entry, an entry which is already recorded is not written
+// again.
+func (cp *Checkpoint) Save(entry CheckpointEntry) error {
+    cp.mu.Lock()
+    defer cp.mu.Unlock()
+    if old, ok := cp.entries[entry.key()]; ok && old == entry {
+        return nil
+    }
+    cp.entries[entry.key()] = entry
+    return cp.write(entry)
+}
+
+func (cp *Checkpoint) SaveHost(table string, window SyncWindow, hostid int) error {
+    return cp.Save(NewCheckpointEntry(table, window, hostid, 0, 0, 0, true))
+}
+
+// Window returns the sync window recorded for the kind of sync, so a resumed
+// run covers the same range as the run it continues.
+func (cp *Checkpoint) Window(kind string) (SyncWindow, bool) {
+    cp.mu.Lock()
+    defer cp.mu.Unlock()
+    entry, ok := cp.entries["window:"+kind]
+    return entry.Window(), ok
+}
+
+func (cp *Checkpoint) SaveWindow(kind string, window SyncWindow) error {
+    return cp.Save(NewCheckpointEntry("window:"+kind, window, 0, 0, 0, 0, false))
+}
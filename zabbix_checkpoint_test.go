@@ -0,0 +1,92 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+    dir, err := ioutil.TempDir("", "zabbix_migrate")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "zabbix_migrate.checkpoint")
+    cp, err := OpenCheckpoint(path, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    window := SyncWindow{From: 1500000000, To: 1700000000}
+    cp.SaveWindow("history", window)
+    cp.Save(NewCheckpointEntry("history", window, 0, 100, 1600000000, 5, false))
+    cp.Save(NewCheckpointEntry("history", window, 0, 100, 1600000100, 7, false))
+    cp.Save(NewCheckpointEntry("history", window, 0, 101, 0, 0, true))
+    cp.SaveHost("history", window, 10084)
+    // a done item of a follow pass without new rows is not written again
+    cp.Save(NewCheckpointEntry("history", window, 0, 101, 0, 0, true))
+    cp.Close()
+    if buf, err := ioutil.ReadFile(path); err != nil || strings.Count(string(buf), "\n") != 5 {
+        t.Fatalf("expect 5 lines in checkpoint, got %q: %v", buf, err)
+    }
+
+    // a rerun without -resume must not wipe the progress
+    if _, err := OpenCheckpoint(path, false, false); err == nil {
+        t.Fatal("checkpoint with progress is started over without -fresh")
+    }
+
+    cp, err = OpenCheckpoint(path, true, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cp.Close()
+    if w, ok := cp.Window("history"); !ok || w != window {
+        t.Fatalf("unexpected checkpoint window: %v", w)
+    }
+    entry, ok := cp.Item("history", window, 100)
+    if !ok || entry.Done || entry.Clock != 1600000100 || entry.Ns != 7 {
+        t.Fatalf("unexpected checkpoint entry: %v", entry)
+    }
+    if entry, ok := cp.Item("history", window, 101); !ok || !entry.Done {
+        t.Fatalf("expect itemid 101 done, got %v", entry)
+    }
+    if _, ok := cp.Item("history", SyncWindow{}, 100); ok {
+        t.Fatal("expect no progress of itemid 100 in another window")
+    }
+    if !cp.HostDone("history", window, 10084) || cp.HostDone("trends", window, 10084) {
+        t.Fatal("unexpected host done of checkpoint")
+    }
+}
+
+func TestCheckpointFresh(t *testing.T) {
+    dir, err := ioutil.TempDir("", "zabbix_migrate")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "zabbix_migrate.checkpoint")
+    window := SyncWindow{From: 1500000000, To: 1700000000}
+    cp, err := OpenCheckpoint(path, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cp.Save(NewCheckpointEntry("history", window, 0, 100, 1600000000, 5, true))
+    cp.Close()
+
+    cp, err = OpenCheckpoint(path, false, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := cp.Item("history", window, 100); ok {
+        t.Error("progress is kept with -fresh")
+    }
+    cp.Close()
+    // the started over file is empty, a plain run can open it again
+    cp, err = OpenCheckpoint(path, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cp.Close()
+}
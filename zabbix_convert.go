@@ -0,0 +1,530 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    ColumnInt = iota
+    ColumnUint
+    ColumnFloat
+    ColumnString
+)
+
+const (
+    IssueNull       = "null"
+    IssueEncoding   = "encoding"
+    IssueNulByte    = "nul byte"
+    IssueTruncated  = "truncated"
+    IssueRejected   = "rejected"
+    IssueLossy      = "lossy"
+    IssueLossyRejected = "lossy rejected"
+)
+
+// value_type of zabbix items
+const (
+    ValueTypeFloat = 0
+    ValueTypeStr   = 1
+    ValueTypeLog   = 2
+    ValueTypeUint  = 3
+    ValueTypeText  = 4
+)
+
+var ValueTypeHistory = map[int]string{
+    ValueTypeFloat: "history",
+    ValueTypeStr: "history_str",
+    ValueTypeLog: "history_log",
+    ValueTypeUint: "history_uint",
+    ValueTypeText: "history_text",
+}
+
+// ValueTypeTrends has no table for the items which are not numeric.
+var ValueTypeTrends = map[int]string{
+    ValueTypeFloat: "trends",
+    ValueTypeUint: "trends_uint",
+}
+
+// ValueTypeTable returns the history or trends table, like the given one,
+// of the value_type.
+func ValueTypeTable(table string, valueType int) string {
+    if strings.HasPrefix(table, "trends") {
+        return ValueTypeTrends[valueType]
+    }
+    return ValueTypeHistory[valueType]
+}
+
+type ColumnSpec struct {
+    Name    string
+    Kind    int
+}
+
+// ColumnLimit is what the target column can hold, read from its
+// information_schema. MaxLen counts bytes when Bytes is set, else characters.
+type ColumnLimit struct {
+    DataType    string
+    MaxLen      int
+    Bytes       bool
+    Precision   int
+    Scale       int
+}
+
+var TableSpecs = map[string][]ColumnSpec{
+    "history": []ColumnSpec{
+        {"itemid", ColumnInt}, {"clock", ColumnInt}, {"value", ColumnFloat}, {"ns", ColumnInt},
+    },
+    "history_uint": []ColumnSpec{
+        {"itemid", ColumnInt}, {"clock", ColumnInt}, {"value", ColumnUint}, {"ns", ColumnInt},
+    },
+    "history_str": []ColumnSpec{
+        {"itemid", ColumnInt}, {"clock", ColumnInt}, {"value", ColumnString}, {"ns", ColumnInt},
+    },
+    "history_text": []ColumnSpec{
+        {"itemid", ColumnInt}, {"clock", ColumnInt}, {"value", ColumnString}, {"ns", ColumnInt},
+    },
+    "history_log": []ColumnSpec{
+        {"itemid", ColumnInt}, {"clock", ColumnInt}, {"timestamp", ColumnInt}, {"source", ColumnString},
+        {"severity", ColumnInt}, {"value", ColumnString}, {"logeventid", ColumnInt}, {"ns", ColumnInt},
+    },
+    "trends": []ColumnSpec{
+        {"itemid", ColumnInt}, {"clock", ColumnInt}, {"num", ColumnInt},
+        {"value_min", ColumnFloat}, {"value_avg", ColumnFloat}, {"value_max", ColumnFloat},
+    },
+    "trends_uint": []ColumnSpec{
+        {"itemid", ColumnInt}, {"clock", ColumnInt}, {"num", ColumnInt},
+        {"value_min", ColumnUint}, {"value_avg", ColumnUint}, {"value_max", ColumnUint},
+    },
+}
+
+// ColumnLimits reads the limits of the table columns on this database once
+// and keeps them for the later calls.
+func (db *ZabbixDB) ColumnLimits(table string) (map[string]ColumnLimit, error) {
+    db.columnMu.Lock()
+    defer db.columnMu.Unlock()
+    if res, ok := db.columnLimits[table]; ok {
+        return res, nil
+    }
+
+    var schemaCond string
+    switch db.DBDriver {
+    case "mysql":
+        schemaCond = "table_schema = database()"
+    case "postgres":
+        schemaCond = "table_schema = current_schema()"
+    }
+    rows, err := db.Query(
+        fmt.Sprintf(`select column_name, data_type, coalesce(character_maximum_length, 0),
+            coalesce(numeric_precision, 0), coalesce(numeric_scale, -1)
+            from information_schema.columns where %s and table_name = ?`, schemaCond),
+        table,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    res := make(map[string]ColumnLimit)
+    for rows.Next() {
+        var name string
+        var limit ColumnLimit
+        err = rows.Scan(&name, &limit.DataType, &limit.MaxLen, &limit.Precision, &limit.Scale)
+        if err != nil {
+            return nil, err
+        }
+        limit.DataType = strings.ToLower(limit.DataType)
+        limit.Bytes = db.DBDriver == "mysql" && strings.HasSuffix(limit.DataType, "text")
+        // only fixed point columns are bounded by precision, double is not
+        if limit.DataType != "numeric" && limit.DataType != "decimal" && limit.Scale <= 0 {
+            limit.Precision = 0
+        }
+        res[strings.ToLower(name)] = limit
+    }
+    err = rows.Err()
+    if err != nil {
+        return nil, err
+    }
+
+    if db.columnLimits == nil {
+        db.columnLimits = make(map[string]map[string]ColumnLimit)
+    }
+    db.columnLimits[table] = res
+    return res, nil
+}
+
+// RowConverter scans the rows of the Source table from the old database into
+// typed values and fits them to the columns of Table on the new one, the
+// changes made on the way are counted in Issues.
+//
+// When the item changed its value_type the tables differ. Columns are taken
+// by name and the ones missing in Source are zero. Values convert without
+// loss from uint to float, from numbers to strings and from strings which
+// parse as number. A float with fraction to uint is rounded and a uint over
+// 2^53 to float loses digits, these lossy values are only written with Lossy,
+// otherwise their row is dropped. Strings which do not parse, negative, NaN
+// or out of range values are always dropped.
+type RowConverter struct {
+    Table   string
+    Specs   []ColumnSpec
+    Source  string
+    SourceSpecs []ColumnSpec
+    Limits  map[string]ColumnLimit
+    Target  string
+    Lossy   bool
+    Issues  map[string]int
+
+    sourceIdx   []int
+}
+
+func (db *ZabbixDB) NewRowConverter(table string) (*RowConverter, error) {
+    return db.NewTableConverter(table, table)
+}
+
+// NewTableConverter converts the rows of the source table into the table on
+// this database.
+func (db *ZabbixDB) NewTableConverter(source string, table string) (*RowConverter, error) {
+    limits, err := db.ColumnLimits(table)
+    if err != nil {
+        log.WithFields(log.Fields{
+            "func": "ZabbixDB.NewRowConverter",
+            "step": "column.limits",
+        }).Warnf("get column limits of %s is failed, convert without limits: %s", table, err)
+        limits = map[string]ColumnLimit{}
+    }
+    return NewConverter(source, table, db.DBDriver, limits, db.Lossy)
+}
+
+// NewConverter converts the rows of the source table into the table on the
+// target db driver with the given column limits.
+func NewConverter(source string, table string, target string, limits map[string]ColumnLimit, lossy bool) (*RowConverter, error) {
+    specs, ok := TableSpecs[table]
+    if !ok {
+        return nil, fmt.Errorf("cannot support convert for the table %s", table)
+    }
+    sourceSpecs, ok := TableSpecs[source]
+    if !ok {
+        return nil, fmt.Errorf("cannot support convert for the table %s", source)
+    }
+    sourceIdx := make([]int, len(specs))
+    for idx, spec := range specs {
+        sourceIdx[idx] = -1
+        for sIdx, sSpec := range sourceSpecs {
+            if sSpec.Name == spec.Name {
+                sourceIdx[idx] = sIdx
+            }
+        }
+    }
+    return &RowConverter{
+        Table: table,
+        Specs: specs,
+        Source: source,
+        SourceSpecs: sourceSpecs,
+        Limits: limits,
+        Target: target,
+        Lossy: lossy,
+        Issues: make(map[string]int),
+        sourceIdx: sourceIdx,
+    }, nil
+}
+
+func (c *RowConverter) Columns() []string {
+    res := make([]string, len(c.Specs))
+    for idx, spec := range c.Specs {
+        res[idx] = spec.Name
+    }
+    return res
+}
+
+func (c *RowConverter) SourceColumns() []string {
+    res := make([]string, len(c.SourceSpecs))
+    for idx, spec := range c.SourceSpecs {
+        res[idx] = spec.Name
+    }
+    return res
+}
+
+// Index is the position of the column in the scanned row of Source.
+func (c *RowConverter) Index(name string) int {
+    for idx, spec := range c.SourceSpecs {
+        if spec.Name == name {
+            return idx
+        }
+    }
+    return -1
+}
+
+// ScanArgs returns new holders for rows.Scan of the SourceColumns, NULL is
+// kept apart from zero.
+func (c *RowConverter) ScanArgs() []interface{} {
+    res := make([]interface{}, len(c.SourceSpecs))
+    for idx, spec := range c.SourceSpecs {
+        switch spec.Kind {
+        case ColumnInt:
+            res[idx] = &sql.NullInt64{}
+        case ColumnFloat:
+            res[idx] = &sql.NullFloat64{}
+        default:
+            res[idx] = &sql.NullString{}
+        }
+    }
+    return res
+}
+
+// Convert turns the scanned holders into a row for the new database with the
+// itemid replaced by mapItemid. The row is false when the target would
+// reject a value that can not be fitted.
+func (c *RowConverter) Convert(args []interface{}, mapItemid int) ([]interface{}, bool) {
+    res := make([]interface{}, len(c.Specs))
+    for idx, spec := range c.Specs {
+        if spec.Name == "itemid" {
+            res[idx] = int64(mapItemid)
+            continue
+        }
+        sIdx := c.sourceIdx[idx]
+        if sIdx < 0 {
+            res[idx] = zeroValue(spec.Kind)
+            continue
+        }
+        limit := c.Limits[spec.Name]
+        sKind := c.SourceSpecs[sIdx].Kind
+        switch spec.Kind {
+        case ColumnInt:
+            v := args[sIdx].(*sql.NullInt64)
+            if !v.Valid {
+                c.Issues[IssueNull]++
+            }
+            res[idx] = v.Int64
+        case ColumnFloat:
+            f, ok := c.toFloat(args[sIdx], sKind)
+            if !ok {
+                return nil, false
+            }
+            if math.IsNaN(f) || math.IsInf(f, 0) {
+                c.Issues[IssueRejected]++
+                return nil, false
+            }
+            if limit.Precision > 0 && limit.Scale >= 0 {
+                max := math.Pow10(limit.Precision - limit.Scale)
+                if math.Abs(f) >= max {
+                    c.Issues[IssueRejected]++
+                    return nil, false
+                }
+            }
+            res[idx] = f
+        case ColumnUint:
+            u, ok := c.toUint(args[sIdx], sKind)
+            if !ok {
+                return nil, false
+            }
+            res[idx] = u
+        case ColumnString:
+            res[idx] = c.fitString(c.toString(args[sIdx], sKind), limit)
+        }
+    }
+    return res, true
+}
+
+func zeroValue(kind int) interface{} {
+    switch kind {
+    case ColumnInt:
+        return int64(0)
+    case ColumnFloat:
+        return float64(0)
+    case ColumnUint:
+        return "0"
+    }
+    return ""
+}
+
+// lossy counts a value which can not be converted exactly, false drops the row.
+func (c *RowConverter) lossy() bool {
+    if !c.Lossy {
+        c.Issues[IssueLossyRejected]++
+        return false
+    }
+    c.Issues[IssueLossy]++
+    return true
+}
+
+func (c *RowConverter) toFloat(arg interface{}, kind int) (float64, bool) {
+    switch kind {
+    case ColumnFloat:
+        v := arg.(*sql.NullFloat64)
+        if !v.Valid {
+            c.Issues[IssueNull]++
+        }
+        return v.Float64, true
+    case ColumnInt:
+        v := arg.(*sql.NullInt64)
+        if !v.Valid {
+            c.Issues[IssueNull]++
+        }
+        return float64(v.Int64), true
+    case ColumnUint:
+        u, ok := c.toUint(arg, kind)
+        if !ok {
+            return 0, false
+        }
+        n, _ := strconv.ParseUint(u, 10, 64)
+        if n > 1<<53 && !c.lossy() {
+            return 0, false
+        }
+        return float64(n), true
+    }
+    v := arg.(*sql.NullString)
+    if !v.Valid {
+        c.Issues[IssueNull]++
+        return 0, true
+    }
+    f, err := strconv.ParseFloat(strings.TrimSpace(v.String), 64)
+    if err != nil {
+        c.Issues[IssueRejected]++
+        return 0, false
+    }
+    return f, true
+}
+
+// toUint returns the value as decimal string, uint64 over the high bit can
+// not be a driver value.
+func (c *RowConverter) toUint(arg interface{}, kind int) (string, bool) {
+    var f float64
+    switch kind {
+    case ColumnUint, ColumnString:
+        v := arg.(*sql.NullString)
+        if !v.Valid {
+            c.Issues[IssueNull]++
+            return "0", true
+        }
+        s := strings.TrimSpace(v.String)
+        if i := strings.IndexByte(s, '.'); i >= 0 && strings.Trim(s[i+1:], "0") == "" {
+            s = s[:i]
+        }
+        if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+            return s, true
+        }
+        if kind == ColumnUint {
+            c.Issues[IssueRejected]++
+            return "", false
+        }
+        var err error
+        f, err = strconv.ParseFloat(s, 64)
+        if err != nil {
+            c.Issues[IssueRejected]++
+            return "", false
+        }
+    case ColumnInt:
+        v := arg.(*sql.NullInt64)
+        if !v.Valid {
+            c.Issues[IssueNull]++
+        }
+        if v.Int64 < 0 {
+            c.Issues[IssueRejected]++
+            return "", false
+        }
+        return strconv.FormatInt(v.Int64, 10), true
+    case ColumnFloat:
+        v := arg.(*sql.NullFloat64)
+        if !v.Valid {
+            c.Issues[IssueNull]++
+        }
+        f = v.Float64
+    }
+    if math.IsNaN(f) || f < 0 || f >= math.MaxUint64 {
+        c.Issues[IssueRejected]++
+        return "", false
+    }
+    if f != math.Trunc(f) && !c.lossy() {
+        return "", false
+    }
+    return strconv.FormatUint(uint64(math.Round(f)), 10), true
+}
+
+func (c *RowConverter) toString(arg interface{}, kind int) string {
+    switch kind {
+    case ColumnInt:
+        v := arg.(*sql.NullInt64)
+        if !v.Valid {
+            c.Issues[IssueNull]++
+        }
+        return strconv.FormatInt(v.Int64, 10)
+    case ColumnFloat:
+        v := arg.(*sql.NullFloat64)
+        if !v.Valid {
+            c.Issues[IssueNull]++
+        }
+        return strconv.FormatFloat(v.Float64, 'f', -1, 64)
+    }
+    v := arg.(*sql.NullString)
+    if !v.Valid {
+        c.Issues[IssueNull]++
+    }
+    s := v.String
+    if kind == ColumnUint {
+        s = strings.TrimSpace(s)
+        if i := strings.IndexByte(s, '.'); i >= 0 && strings.Trim(s[i+1:], "0") == "" {
+            s = s[:i]
+        }
+    }
+    return s
+}
+
+func (c *RowConverter) fitString(s string, limit ColumnLimit) string {
+    if !utf8.ValidString(s) {
+        c.Issues[IssueEncoding]++
+        s = strings.ToValidUTF8(s, "�")
+    }
+    if c.Target == "postgres" && strings.IndexByte(s, 0) >= 0 {
+        c.Issues[IssueNulByte]++
+        s = strings.Replace(s, "\x00", "", -1)
+    }
+    if limit.MaxLen <= 0 {
+        return s
+    }
+    if limit.Bytes {
+        if len(s) <= limit.MaxLen {
+            return s
+        }
+        c.Issues[IssueTruncated]++
+        cut := limit.MaxLen
+        for cut > 0 && !utf8.RuneStart(s[cut]) {
+            cut--
+        }
+        return s[:cut]
+    }
+    if utf8.RuneCountInString(s) <= limit.MaxLen {
+        return s
+    }
+    c.Issues[IssueTruncated]++
+    return string([]rune(s)[:limit.MaxLen])
+}
+
+func (c *RowConverter) IssueString() string {
+    keys := make([]string, 0, len(c.Issues))
+    for key := range c.Issues {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    parts := make([]string, len(keys))
+    for idx, key := range keys {
+        parts[idx] = fmt.Sprintf("%d %s", c.Issues[key], key)
+    }
+    return strings.Join(parts, ", ")
+}
+
+// Report logs what had to be changed to fit the rows of the item, in the
+// validate mode this is the whole output of the sync.
+func (c *RowConverter) Report(itemid int) {
+    if len(c.Issues) == 0 {
+        return
+    }
+    log.WithFields(log.Fields{
+        "func": "RowConverter.Report",
+        "step": "issues",
+    }).Warnf("%s itemid [%d] values not fit for %s %s: %s", c.Source, itemid, c.Target, c.Table, c.IssueString())
+}
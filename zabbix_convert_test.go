@@ -0,0 +1,107 @@
+package main
+
+import (
+    "database/sql"
+    "strings"
+    "testing"
+)
+
+func TestRowConverter(t *testing.T) {
+    conv, _ := NewConverter("history_log", "history_log", "postgres", map[string]ColumnLimit{
+        "source": ColumnLimit{DataType: "character varying", MaxLen: 4},
+    }, false)
+    args := conv.ScanArgs()
+    *args[0].(*sql.NullInt64) = sql.NullInt64{Int64: 100, Valid: true}
+    *args[1].(*sql.NullInt64) = sql.NullInt64{Int64: 1600000000, Valid: true}
+    *args[3].(*sql.NullString) = sql.NullString{String: "sourcé", Valid: true}
+    *args[5].(*sql.NullString) = sql.NullString{String: "a\x00b\xff", Valid: true}
+    row, ok := conv.Convert(args, 200)
+    if !ok {
+        t.Fatal("expect row to be converted")
+    }
+    if row[0] != int64(200) || row[3] != "sour" || row[5] != "ab�" {
+        t.Fatalf("unexpected converted row: %v", row)
+    }
+    if conv.IssueString() != "1 encoding, 1 nul byte, 4 null, 1 truncated" {
+        t.Fatalf("unexpected convert issues: %s", conv.IssueString())
+    }
+
+    conv, _ = NewConverter("history", "history", "postgres", map[string]ColumnLimit{
+        "value": ColumnLimit{DataType: "numeric", Precision: 16, Scale: 4},
+    }, false)
+    args = conv.ScanArgs()
+    *args[2].(*sql.NullFloat64) = sql.NullFloat64{Float64: 1e13, Valid: true}
+    if _, ok := conv.Convert(args, 200); ok || conv.Issues[IssueRejected] != 1 {
+        t.Fatal("expect value out of numeric(16,4) to be rejected")
+    }
+
+    conv, _ = NewConverter("history_uint", "history_uint", "mysql", map[string]ColumnLimit{}, false)
+    args = conv.ScanArgs()
+    *args[2].(*sql.NullString) = sql.NullString{String: "18446744073709551615.0000", Valid: true}
+    if row, ok := conv.Convert(args, 200); !ok || row[2] != "18446744073709551615" {
+        t.Fatalf("unexpected uint convert: %v", row)
+    }
+}
+
+func TestValueTypeConvert(t *testing.T) {
+    conv, _ := NewConverter("history", "history_uint", "mysql", map[string]ColumnLimit{}, false)
+    if strings.Join(conv.SourceColumns(), ",") != "itemid,clock,value,ns" || conv.Index("ns") != 3 {
+        t.Fatalf("unexpected source columns: %v", conv.SourceColumns())
+    }
+    args := conv.ScanArgs()
+    *args[2].(*sql.NullFloat64) = sql.NullFloat64{Float64: 41.6, Valid: true}
+    if _, ok := conv.Convert(args, 200); ok || conv.Issues[IssueLossyRejected] != 1 {
+        t.Fatal("expect float with fraction to uint to be rejected without lossy")
+    }
+    conv.Lossy = true
+    if row, ok := conv.Convert(args, 200); !ok || row[2] != "42" || conv.Issues[IssueLossy] != 1 {
+        t.Fatalf("unexpected lossy float to uint convert: %v", row)
+    }
+    *args[2].(*sql.NullFloat64) = sql.NullFloat64{Float64: -1, Valid: true}
+    if _, ok := conv.Convert(args, 200); ok {
+        t.Fatal("expect negative float to uint to be rejected")
+    }
+
+    conv, _ = NewConverter("history_uint", "history_str", "mysql", map[string]ColumnLimit{}, false)
+    args = conv.ScanArgs()
+    *args[2].(*sql.NullString) = sql.NullString{String: "18446744073709551615", Valid: true}
+    if row, ok := conv.Convert(args, 200); !ok || row[2] != "18446744073709551615" {
+        t.Fatalf("unexpected uint to str convert: %v", row)
+    }
+
+    conv, _ = NewConverter("history_text", "history", "mysql", map[string]ColumnLimit{}, false)
+    args = conv.ScanArgs()
+    *args[2].(*sql.NullString) = sql.NullString{String: " 1.5 ", Valid: true}
+    if row, ok := conv.Convert(args, 200); !ok || row[2] != 1.5 {
+        t.Fatalf("unexpected text to float convert: %v", row)
+    }
+    *args[2].(*sql.NullString) = sql.NullString{String: "up", Valid: true}
+    if _, ok := conv.Convert(args, 200); ok || conv.Issues[IssueRejected] != 1 {
+        t.Fatal("expect text which is no number to be rejected")
+    }
+
+    conv, _ = NewConverter("history_str", "history_log", "mysql", map[string]ColumnLimit{}, false)
+    args = conv.ScanArgs()
+    *args[2].(*sql.NullString) = sql.NullString{String: "line", Valid: true}
+    if row, ok := conv.Convert(args, 200); !ok || row[5] != "line" || row[3] != "" || row[7] != int64(0) {
+        t.Fatalf("unexpected str to log convert: %v", row)
+    }
+
+    conv, _ = NewConverter("trends_uint", "trends", "mysql", map[string]ColumnLimit{}, false)
+    args = conv.ScanArgs()
+    *args[2].(*sql.NullInt64) = sql.NullInt64{Int64: 60, Valid: true}
+    *args[3].(*sql.NullString) = sql.NullString{String: "1", Valid: true}
+    *args[4].(*sql.NullString) = sql.NullString{String: "2", Valid: true}
+    *args[5].(*sql.NullString) = sql.NullString{String: "3", Valid: true}
+    if row, ok := conv.Convert(args, 200); !ok || row[2] != int64(60) || row[4] != float64(2) {
+        t.Fatalf("unexpected trends_uint to trends convert: %v", row)
+    }
+
+    mapping := ItemMapping{ValueTypes: map[int]int{100: ValueTypeFloat, 101: ValueTypeText}}
+    if mapping.TargetTable("history_uint", 100) != "history" || mapping.TargetTable("trends_uint", 100) != "trends" {
+        t.Fatal("unexpected target table for float item")
+    }
+    if mapping.TargetTable("trends", 101) != "" || mapping.TargetTable("history_str", 102) != "history_str" {
+        t.Fatal("unexpected target table for text or unknown item")
+    }
+}
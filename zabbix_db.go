@@ -4,6 +4,9 @@ import (
     "database/sql"
     "errors"
     "fmt"
+    "strconv"
+    "strings"
+    "sync"
     "time"
 
     log "github.com/sirupsen/logrus"
@@ -19,9 +22,29 @@ type ZabbixDB struct {
     DBDriver    string
     Database    string
     DBVersion   int
+    BatchSize   int
+    BulkLoad    bool
+    Checkpoint  *Checkpoint
+    Follow      bool
+    ValidateOnly bool
+    TimescaleVersion    string
+    TimescaleDecompress bool
+    TimescaleProgress   *TimescaleProgress
+    Rename      *RenameMap
+    Lossy       bool
+    Elastic     *ElasticHistory
     DB          *sql.DB
+
+    columnMu     sync.Mutex
+    columnLimits map[string]map[string]ColumnLimit
 }
 
+const DefaultBatchSize = 500
+
+// the bind parameters of a statement are limited to 65535 by the protocol of
+// mysql and postgres
+const MaxPlaceholders = 65535
+
 type HostMap map[int]string
 type ItemMap map[int]string
 
@@ -60,6 +83,7 @@ func NewZabbixDB(dbDriver string, host string, port int, user string, password s
         password: password,
         DBDriver: dbDriver,
         DBVersion: dbVersion,
+        BatchSize: DefaultBatchSize,
         Database: database,
         DB: db,
     }, nil
@@ -73,8 +97,56 @@ func (db *ZabbixDB) Close() error {
     return nil
 }
 
+// SetConnPool limits the connections held by the pool, zero keeps the
+// default of database/sql.
+func (db *ZabbixDB) SetConnPool(maxOpen int, maxIdle int) {
+    if maxOpen > 0 {
+        db.DB.SetMaxOpenConns(maxOpen)
+    }
+    if maxIdle > 0 {
+        db.DB.SetMaxIdleConns(maxIdle)
+    }
+}
+
+// Rebind turns the ? placeholders of a query into the style of the driver,
+// $1, $2 ... for postgres, the ? inside of quoted strings are kept.
+func (db *ZabbixDB) Rebind(query string) string {
+    if db.DBDriver != "postgres" {
+        return query
+    }
+
+    var b strings.Builder
+    n := 1
+    inQuote := false
+    for _, c := range query {
+        switch {
+        case c == '\'':
+            inQuote = !inQuote
+            b.WriteRune(c)
+        case c == '?' && !inQuote:
+            fmt.Fprintf(&b, "$%d", n)
+            n++
+        default:
+            b.WriteRune(c)
+        }
+    }
+    return b.String()
+}
+
+func (db *ZabbixDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+    return db.DB.Query(db.Rebind(query), args...)
+}
+
+func (db *ZabbixDB) QueryRow(query string, args ...interface{}) *sql.Row {
+    return db.DB.QueryRow(db.Rebind(query), args...)
+}
+
+func (db *ZabbixDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+    return db.DB.Exec(db.Rebind(query), args...)
+}
+
 func (db *ZabbixDB) GetTemplateList() ([]int, error) {
-    rows, err := db.DB.Query("select hostid from hosts where status = 3 order by hostid")
+    rows, err := db.Query("select hostid from hosts where status = 3 order by hostid")
     if err != nil {
         return []int{}, err
     }
@@ -93,9 +165,9 @@ func (db *ZabbixDB) GetHostList(hostgroup string, hostIdBegin int) ([]int, error
     var rows *sql.Rows
     var err error
     if hostgroup == "" {
-        rows, err = db.DB.Query("select hostid from hosts where status != 3 and hostid >= ? order by hostid", hostIdBegin)
+        rows, err = db.Query("select hostid from hosts where status != 3 and hostid >= ? order by hostid", hostIdBegin)
     } else {
-        rows, err = db.DB.Query(
+        rows, err = db.Query(
             `select hg.hostid from hosts_groups hg left join hosts h on hg.hostid = h.hostid where h.status = 0 and h.hostid >= ? and hg.groupid in (select groupid from hstgrp g where g.name = ?) order by hg.hostid`, 
             hostIdBegin,
             hostgroup,
@@ -122,9 +194,9 @@ func (db *ZabbixDB) GetHostMapList(hostgroup string, hostIdBegin int, offset uin
         offset = 999999999
     }
     if hostgroup == "" {
-        rows, err = db.DB.Query("select hostid, host from hosts where status = 0 and hostid >= ? and h.status != 3 order by hostid limit ?", hostIdBegin, offset)
+        rows, err = db.Query("select hostid, host from hosts where status = 0 and hostid >= ? order by hostid limit ?", hostIdBegin, offset)
     } else {
-        rows, err = db.DB.Query(`select hg.hostid, h.host from hosts_groups hg left join hosts h on hg.hostid = h.hostid where h.hostid >= ? and h.status != 3 and hg.groupid in (select groupid  from hstgrp g where g.name = ?) order by hg.hostid limit ?`, 
+        rows, err = db.Query(`select hg.hostid, h.host from hosts_groups hg left join hosts h on hg.hostid = h.hostid where h.hostid >= ? and h.status != 3 and hg.groupid in (select groupid  from hstgrp g where g.name = ?) order by hg.hostid limit ?`, 
             hostIdBegin,
             hostgroup,
             offset,
@@ -145,8 +217,58 @@ func (db *ZabbixDB) GetHostMapList(hostgroup string, hostIdBegin int, offset uin
     return res, nil
 }
 
+func (db *ZabbixDB) GetHostGroupNames(hostid int) ([]string, error) {
+    rows, err := db.Query("select g.name from hosts_groups hg join hstgrp g on hg.groupid = g.groupid where hg.hostid = ? order by g.name", hostid)
+    if err != nil {
+        return []string{}, err
+    }
+    defer rows.Close()
+
+    res := make([]string, 0)
+    for rows.Next() {
+        var name string
+        rows.Scan(&name)
+        res = append(res, name)
+    }
+    return res, rows.Err()
+}
+
+// GetItemTags returns the tags of the items of the host by itemid, the values
+// of a tag repeated on an item are joined by comma in order. Zabbix before
+// 5.4 has no item_tag table and returns none.
+func (db *ZabbixDB) GetItemTags(hostid int) (map[int]map[string]string, error) {
+    res := make(map[int]map[string]string)
+    columns, err := db.ColumnLimits("item_tag")
+    if err != nil {
+        return nil, err
+    }
+    if len(columns) == 0 {
+        return res, nil
+    }
+    rows, err := db.Query("select it.itemid, it.tag, it.value from item_tag it join items i on it.itemid = i.itemid where i.hostid = ? order by it.itemid, it.tag, it.value", hostid)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var itemid int
+        var tag, value string
+        rows.Scan(&itemid, &tag, &value)
+        if _, ok := res[itemid]; !ok {
+            res[itemid] = make(map[string]string)
+        }
+        // a tag can be repeated with other values on an item
+        if v, ok := res[itemid][tag]; ok {
+            value = v + "," + value
+        }
+        res[itemid][tag] = value
+    }
+    return res, rows.Err()
+}
+
 func (db *ZabbixDB) GetItemList(hostid int) ([]int, error) {
-    rows, err := db.DB.Query("select itemid from items where flags not in (1,2) and hostid = ? order by itemid", hostid)
+    rows, err := db.Query("select itemid from items where flags not in (1,2) and hostid = ? order by itemid", hostid)
     if err != nil {
         return []int{}, err
     }
@@ -162,7 +284,7 @@ func (db *ZabbixDB) GetItemList(hostid int) ([]int, error) {
 }
 
 func (db *ZabbixDB) GetItemMap(hostid int) (ItemMap, error) {
-    rows, err := db.DB.Query("select itemid, key_ from items where flags not in (1,2) and hostid = ? order by itemid", hostid)
+    rows, err := db.Query("select itemid, key_ from items where flags not in (1,2) and hostid = ? order by itemid", hostid)
     if err != nil {
         return ItemMap{}, err
     }
@@ -178,35 +300,184 @@ func (db *ZabbixDB) GetItemMap(hostid int) (ItemMap, error) {
     return res, nil
 }
 
-func (db *ZabbixDB) MappingItemId(host string, iMap ItemMap) (map[int]int, error) {
+// GetItemValueTypes returns the value_type of the items of the host, their
+// rows are in the history and trends tables of it.
+func (db *ZabbixDB) GetItemValueTypes(hostid int) (map[int]int, error) {
+    rows, err := db.Query("select itemid, value_type from items where flags not in (1,2) and hostid = ?", hostid)
+    if err != nil {
+        return map[int]int{}, err
+    }
+    defer rows.Close()
+
     res := make(map[int]int)
-    for itemid, key_ := range iMap {
-        var row *sql.Row
-        sql_ := fmt.Sprintf("select i.itemid from items i left join hosts h on i.hostid = h.hostid where i.flags not in (1,2) and h.host = '%s' and i.key_ = '%s'", host, key_)
-        switch db.DBDriver {
-        case "mysql":
-            row = db.DB.QueryRow(sql_)
-        case "postgres":
-            row = db.DB.QueryRow(sql_)
-        }
+    for rows.Next() {
+        var itemid, valueType int
+        rows.Scan(&itemid, &valueType)
+        res[itemid] = valueType
+    }
+    return res, rows.Err()
+}
 
-        var _itemid int
-        err := row.Scan(&_itemid)
-        if err != nil {
-            switch {
-            case err == sql.ErrNoRows:
-            case err != nil:
-                return map[int]int{}, err
+// GetDiscoveredItemMap returns the items created by low level discovery on
+// the host, they exist on the new zabbix only after its discovery has run.
+func (db *ZabbixDB) GetDiscoveredItemMap(hostid int) (ItemMap, error) {
+    rows, err := db.Query("select itemid, key_ from items where flags = 4 and hostid = ? order by itemid", hostid)
+    if err != nil {
+        return ItemMap{}, err
+    }
+    defer rows.Close()
+
+    res := make(ItemMap, 0)
+    for rows.Next() {
+        var itemid int
+        var key_ string
+        rows.Scan(&itemid, &key_)
+        res[itemid] = key_
+    }
+    return res, rows.Err()
+}
+
+func (db *ZabbixDB) GetDiscoveryRuleList(host string) ([]int, error) {
+    rows, err := db.Query("select i.itemid from items i join hosts h on i.hostid = h.hostid where i.flags = 1 and i.status = 0 and h.host = ? order by i.itemid", host)
+    if err != nil {
+        return []int{}, err
+    }
+    defer rows.Close()
+
+    res := make([]int, 0)
+    for rows.Next() {
+        var itemid int
+        rows.Scan(&itemid)
+        res = append(res, itemid)
+    }
+    return res, rows.Err()
+}
+
+// ItemMapping maps the itemids of one host to the itemids on this zabbix by
+// key_, the items without counterpart are kept in Unmapped. Host and keys
+// are renamed by Rename first, a renamed key falls back to the old one.
+// ValueTypes keeps the value_type of the mapped items on this zabbix.
+type ItemMapping struct {
+    Itemids     map[int]int
+    ValueTypes  map[int]int
+    Unmapped    ItemMap
+}
+
+// TargetTable returns the table on this zabbix for the rows of the item in
+// the history or trends table, it differs when the value_type was changed
+// and is empty when the item has no trends any more.
+func (m ItemMapping) TargetTable(table string, itemid int) string {
+    valueType, ok := m.ValueTypes[itemid]
+    if !ok {
+        return table
+    }
+    return ValueTypeTable(table, valueType)
+}
+
+func (db *ZabbixDB) MappingItemId(host string, iMap ItemMap) (ItemMapping, error) {
+    res := ItemMapping{
+        Itemids: make(map[int]int),
+        ValueTypes: make(map[int]int),
+        Unmapped: make(ItemMap),
+    }
+
+    rows, err := db.Query("select i.itemid, i.key_, i.value_type from items i join hosts h on i.hostid = h.hostid where i.flags not in (1,2) and h.host = ?", db.Rename.Host(host))
+    if err != nil {
+        return ItemMapping{}, err
+    }
+    defer rows.Close()
+
+    keyMap := make(map[string]int)
+    valueTypes := make(map[int]int)
+    for rows.Next() {
+        var itemid, valueType int
+        var key_ string
+        rows.Scan(&itemid, &key_, &valueType)
+        keyMap[key_] = itemid
+        valueTypes[itemid] = valueType
+    }
+    err = rows.Err()
+    if err != nil {
+        return ItemMapping{}, err
+    }
+
+    for itemid, key_ := range iMap {
+        if newKey, ok := db.Rename.Key(key_); ok {
+            if _itemid, ok := keyMap[newKey]; ok {
+                res.Itemids[itemid] = _itemid
+                res.ValueTypes[itemid] = valueTypes[_itemid]
+                continue
             }
         }
-        res[itemid] = _itemid
+        if _itemid, ok := keyMap[key_]; ok {
+            res.Itemids[itemid] = _itemid
+            res.ValueTypes[itemid] = valueTypes[_itemid]
+        } else {
+            res.Unmapped[itemid] = key_
+        }
     }
     return res, nil
 }
 
-func (db *ZabbixDB) SyncHistoryToOne(bZDB *ZabbixDB, hTable string, hostid int, host string, offsetDay uint, ignoreErr bool) error {
+// SyncWindow limits the clock of synced rows to [From, To), a zero bound is
+// left open.
+type SyncWindow struct {
+    From    int64
+    To      int64
+}
+
+const MaxClock int64 = 2147483647
+
+func (w SyncWindow) Bounds() (int64, int64) {
+    to := w.To
+    if to == 0 {
+        to = MaxClock
+    }
+    return w.From, to
+}
+
+func (w SyncWindow) String() string {
+    from, to := w.Bounds()
+    return fmt.Sprintf("%d-%d", from, to)
+}
+
+// ParseSyncTime accepts a unix timestamp, a date as 2006-01-02, 2006-01-02
+// 15:04:05 or RFC3339 in local time, or a duration back from now such as 90d
+// or 36h. The empty string is the open bound 0.
+func ParseSyncTime(s string, now time.Time) (int64, error) {
+    if s == "" {
+        return 0, nil
+    }
+    if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+        return ts, nil
+    }
+    if strings.HasSuffix(s, "d") {
+        days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+        if err == nil {
+            return now.AddDate(0, 0, -days).Unix(), nil
+        }
+    }
+    if dur, err := time.ParseDuration(s); err == nil {
+        return now.Add(-dur).Unix(), nil
+    }
+    for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+        if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+            return t.Unix(), nil
+        }
+    }
+    return 0, errors.New("cannot parse sync time " + s)
+}
+
+func (db *ZabbixDB) SyncHistoryToOne(bZDB *ZabbixDB, hTable string, hostid int, host string, window SyncWindow, ignoreErr bool) error {
     var err error
-    var value string
+
+    if db.Checkpoint != nil && !db.Follow && db.Checkpoint.HostDone(hTable, window, hostid) {
+        log.WithFields(log.Fields{
+            "func": "ZabbixDB.SyncHistoryToOne",
+            "step": "checkpoint",
+        }).Debugf("skip %s hostid [%d], already done in checkpoint", hTable, hostid)
+        return nil
+    }
 
     aHostid := hostid
     aHost := host
@@ -218,185 +489,261 @@ func (db *ZabbixDB) SyncHistoryToOne(bZDB *ZabbixDB, hTable string, hostid int,
     if err != nil {
         return err
     }
-    mappingI, err := bZDB.MappingItemId(aHost, aItemMap)
+    mapping, err := bZDB.MappingItemId(aHost, aItemMap)
     if err != nil {
         return err
     }
+    mappingI := mapping.Itemids
 
-    endClock := time.Now().Unix() - 3600*24*int64(offsetDay)
-    limitOffset := 1000
+    hasFailed := false
+    for _, itemid := range aItemList {
+        log.WithFields(log.Fields{
+            "func": "ZabbixDB.SyncHistoryToOne",
+            "step": "insert",
+        }).Tracef("prepare sql hostid [%d] itemid [%d] mapItemid [%d]", aHostid, itemid, mappingI[itemid])
 
-    if hTable != "history_log" {
-        sql1 := fmt.Sprintf("select * from %s where itemid = ? and clock < ? limit ? offset ?", hTable)
-        var sql2 string
-        switch bZDB.DBDriver {
-        case "mysql":
-            sql2 = fmt.Sprintf("insert into %s values(?, ?, ?, ?)", hTable)
-        case "postgres":
-            sql2 = fmt.Sprintf("insert into %s values($1, $2, $3, $4)", hTable)
+        if _, ok := mappingI[itemid]; !ok {
+            log.WithFields(log.Fields{
+                "func": "ZabbixDB.SyncHistoryToOne",
+                "step": "insert",
+            }).Errorf("not found itemid mapping for itemid [%d] key [%s]", itemid, mapping.Unmapped[itemid])
+            continue
         }
 
-        for _, itemid := range aItemList {
+        toTable := mapping.TargetTable(hTable, itemid)
+        if toTable != hTable {
             log.WithFields(log.Fields{
                 "func": "ZabbixDB.SyncHistoryToOne",
-                "step": "insert",
-            }).Tracef("prepare sql hostid [%d] itemid [%d] mapItemid [%d]", aHostid, itemid, mappingI[itemid])
+                "step": "value.type",
+            }).Debugf("value_type of itemid [%d] mapItemid [%d] is changed, convert %s to %s", itemid, mappingI[itemid], hTable, toTable)
+        }
 
-            if val, ok := mappingI[itemid]; !ok || val == 0 {
+        iCount, err := db.SyncHistoryItem(bZDB, hTable, toTable, itemid, mappingI[itemid], window)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "ZabbixDB.SyncHistoryToOne",
+                "step": "insert",
+            }).Errorf("try to sync %s hostid [%d] itemid [%d] is failed", hTable, aHostid, itemid)
+            if ignoreErr {
+                hasFailed = true
                 log.WithFields(log.Fields{
                     "func": "ZabbixDB.SyncHistoryToOne",
                     "step": "insert",
-                }).Errorf("not found itemid mapping for itemid [%d]", itemid)
+                }).Info("ignore error ...")
                 continue
             }
+            return err
+        }
 
-            limitStart := 0
-            for {
-                log.WithFields(log.Fields{
-                    "func": "ZabbixDB.SyncHistoryToOne",
-                    "step": "select.sql",
-                }).Tracef(
-                    "prepare sql: itemid [%d] endClock [%d] limitStart [%d] limitOffset [%d]", 
-                    itemid,
-                    endClock,
-                    limitStart,
-                    limitOffset,
-                )
-
-                aRows, err := db.DB.Query(sql1, itemid, endClock, limitOffset, limitStart)
-                if err != nil {
-                    return err
-                }
+        log.WithFields(log.Fields{
+            "func": "ZabbixDB.SyncHistoryToOne",
+            "step": "insert",
+        }).Tracef("done sync %s hostid [%d] itemid [%d] mapItemid [%d], insert count is %d", hTable, aHostid, itemid, mappingI[itemid], iCount)
+    }
 
-                isEmpty := true
-                iCount := 0
-                for aRows.Next() {
-                    isEmpty = false
-                    var _itemid int
-                    var _clock int
-                    var _ns int
-                    aRows.Scan(&_itemid, &_clock, &value, &_ns)
-                    _, err := bZDB.DB.Exec(
-                        sql2, 
-                        mappingI[itemid], _clock, value, _ns,
-                    )
-                    if err != nil {
-                        log.WithFields(log.Fields{
-                            "func": "ZabbixDB.SyncHistoryToOne",
-                            "step": "insert",
-                        }).Errorf("try to sync hostid [%d] itemid [%d] is failed", aHostid, itemid)
-                        break
-                    }
-                    iCount++
-                }
+    if db.Checkpoint != nil && !hasFailed {
+        return db.Checkpoint.SaveHost(hTable, window, aHostid)
+    }
+    return nil
+}
 
-                log.WithFields(log.Fields{
-                    "func": "ZabbixDB.SyncHistoryToOne",
-                    "step": "insert",
-                }).Tracef("done sync %s hostid [%d] itemid [%d] mapItemid [%d], insert count is %d", hTable, aHostid, itemid, mappingI[itemid], iCount)
+// historyPageRows is the count of rows per page of SyncHistoryItem.
+var historyPageRows = 1000
+
+// SyncHistoryItem copies the history of one item inside of the window into
+// mapItemid of toTable on bZDB and returns the count of inserted rows. The
+// rows are paged by the (clock, ns) keyset of the item, so every page is an
+// index range scan. History tables before zabbix 6.0 have no primary key and
+// can hold rows of the same (clock, ns), there the next page starts at the
+// last (clock, ns) again and skips the rows of it already read. The count of
+// them is not in the checkpoint, a resume goes on after the last (clock, ns).
+func (db *ZabbixDB) SyncHistoryItem(bZDB *ZabbixDB, hTable string, toTable string, itemid int, mapItemid int, window SyncWindow) (int, error) {
+    conv, err := bZDB.NewTableConverter(hTable, toTable)
+    if err != nil {
+        return 0, err
+    }
+    defer conv.Report(itemid)
+
+    limitOffset := historyPageRows
+    columns := conv.Columns()
+    clockIdx := conv.Index("clock")
+    nsIdx := conv.Index("ns")
+    // rows of the same (clock, ns) are ordered by all columns, so the rows
+    // to skip are the same on every page
+    dupKeys := db.DBVersion < 6
+    order := []string{"clock", "ns"}
+    if dupKeys {
+        for _, name := range conv.SourceColumns() {
+            if name != "itemid" && name != "clock" && name != "ns" {
+                order = append(order, name)
+            }
+        }
+    }
+    sql1 := fmt.Sprintf(
+        "select %s from %s where itemid = ? and clock < ? and clock >= ? and (clock > ? or ns > ?) order by %s limit ?",
+        strings.Join(conv.SourceColumns(), ", "),
+        hTable,
+        strings.Join(order, ", "),
+    )
+    sql2 := fmt.Sprintf("insert into %s (%s) values ", toTable, strings.Join(columns, ", "))
+    fromIndex, fromElastic := db.Elastic.Index(hTable)
+    toIndex, toElastic := bZDB.Elastic.Index(toTable)
+
+    beginClock, endClock := window.Bounds()
+    iCount := 0
+    lastClock := int(beginClock)
+    lastNs := -1
+    if db.Checkpoint != nil {
+        if entry, ok := db.Checkpoint.Item(hTable, window, itemid); ok {
+            // in follow mode a done item is only caught up, go on from its last clock
+            if entry.Done && !db.Follow {
+                return 0, nil
+            }
+            lastClock, lastNs = entry.Clock, entry.Ns
+        }
+    }
+    // skip is the count of rows at (lastClock, lastNs) already read, -1
+    // when the next page starts after them
+    skip := -1
+    for {
+        log.WithFields(log.Fields{
+            "func": "ZabbixDB.SyncHistoryItem",
+            "step": "select.sql",
+        }).Tracef(
+            "prepare sql: itemid [%d] endClock [%d] lastClock [%d] lastNs [%d] limitOffset [%d]", 
+            itemid,
+            endClock,
+            lastClock,
+            lastNs,
+            limitOffset,
+        )
 
-                aRows.Close()
+        read := 0
+        last := false
+        page := make([][]interface{}, 0, limitOffset)
+        if fromElastic {
+            docs, err := db.Elastic.Search(fromIndex, conv.SourceColumns(), itemid, endClock, lastClock, lastNs, limitOffset)
+            if err != nil {
+                return iCount, err
+            }
+            for _, doc := range docs {
+                args := conv.ScanArgs()
+                err = conv.SetArgs(args, doc)
                 if err != nil {
-                    return err
+                    return iCount, fmt.Errorf("elasticsearch %s itemid [%d]: %s", fromIndex, itemid, err)
                 }
-                if isEmpty {
-                    break
+                read++
+                lastClock = int(args[clockIdx].(*sql.NullInt64).Int64)
+                lastNs = int(args[nsIdx].(*sql.NullInt64).Int64)
+                if row, ok := conv.Convert(args, mapItemid); ok {
+                    page = append(page, row)
                 }
-                limitStart += limitOffset
             }
-        }
-    } else {
-        sql1 := fmt.Sprintf("select * from %s where itemid = ? and clock < ? limit ? offset ?", hTable)
-        var sql2 string
-        switch bZDB.DBDriver {
-        case "mysql":
-            sql2 = fmt.Sprintf("insert into %s values(?, ?, ?, ?, ?, ?, ?, ?)", hTable)
-        case "postgres":
-            sql2 = fmt.Sprintf("insert into %s values($1, $2, $3, $4, $5, $6, $7, $8)", hTable)
-        }
-
-        for _, itemid := range aItemList {
-            log.WithFields(log.Fields{
-                "func": "ZabbixDB.SyncHistoryToOne",
-                "step": "insert",
-            }).Tracef("prepare sql hostid [%d] itemid [%d] mapItemid [%d]", aHostid, itemid, mappingI[itemid])
-
-            if val, ok := mappingI[itemid]; !ok || val == 0 {
-                log.WithFields(log.Fields{
-                    "func": "ZabbixDB.SyncHistoryToOne",
-                    "step": "insert",
-                }).Errorf("not found itemid mapping for itemid [%d]", itemid)
-                continue
+            last = read < limitOffset
+        } else {
+            nsArg, limit, same := lastNs, limitOffset, 0
+            if skip >= 0 {
+                nsArg, limit, same = lastNs-1, limitOffset+skip, skip
+            }
+            aRows, err := db.Query(sql1, itemid, endClock, lastClock, lastClock, nsArg, limit)
+            if err != nil {
+                return iCount, err
             }
 
-            limitStart := 0
-            for {
-                log.WithFields(log.Fields{
-                    "func": "ZabbixDB.SyncHistoryToOne",
-                    "step": "select.sql",
-                }).Tracef(
-                    "prepare sql: itemid [%d] endClock [%d] limitStart [%d] limitOffset [%d]", 
-                    itemid,
-                    endClock,
-                    limitStart,
-                    limitOffset,
-                )
-
-                aRows, err := db.DB.Query(sql1, itemid, endClock, limitOffset, limitStart)
+            got := 0
+            for aRows.Next() {
+                args := conv.ScanArgs()
+                err = aRows.Scan(args...)
                 if err != nil {
-                    return err
+                    break
                 }
-
-                isEmpty := true
-                iCount := 0
-                for aRows.Next() {
-                    isEmpty = false
-                    var _itemid int
-                    var _clock int
-                    var _timestamp int
-                    var _source string
-                    var _severity int
-                    var _logeventid int
-                    var _ns int
-                    aRows.Scan(&_itemid, &_clock, &_timestamp, &_source, &_severity, &value, &_logeventid, &_ns)
-                    _, err =bZDB.DB.Exec(
-                        sql2, 
-                        mappingI[itemid], _clock, _timestamp, _source, _severity, value, _logeventid, _ns,
-                    )
-                    if err != nil {
-                        log.WithFields(log.Fields{
-                            "func": "ZabbixDB.SyncHistoryToOne",
-                            "step": "insert",
-                        }).Errorf("try to sync %s hostid [%d] itemid [%d] is failed", hTable, aHostid, itemid)
-                        break
-                    }
-                    iCount++
+                got++
+                if got <= skip {
+                    continue
                 }
+                read++
+                clock := int(args[clockIdx].(*sql.NullInt64).Int64)
+                ns := int(args[nsIdx].(*sql.NullInt64).Int64)
+                if clock == lastClock && ns == lastNs {
+                    same++
+                } else {
+                    lastClock, lastNs, same = clock, ns, 1
+                }
+                if row, ok := conv.Convert(args, mapItemid); ok {
+                    page = append(page, row)
+                }
+            }
+            if err == nil {
+                err = aRows.Err()
+            }
+            aRows.Close()
+            if err != nil {
+                return iCount, err
+            }
+            if dupKeys {
+                skip = same
+            }
+            last = got < limit
+        }
+        if read == 0 {
+            break
+        }
 
-                log.WithFields(log.Fields{
-                    "func": "ZabbixDB.SyncHistoryToOne",
-                    "step": "insert",
-                }).Tracef("done sync %s hostid [%d] itemid [%d] mapItemid [%d], insert count is %d", hTable, aHostid, itemid, mappingI[itemid], iCount)
-
-                aRows.Close()
+        if len(page) > 0 && !bZDB.ValidateOnly && toElastic {
+            err = bZDB.Elastic.Bulk(toIndex, columns, page)
+            if err != nil {
+                return iCount, err
+            }
+        } else if len(page) > 0 && !bZDB.ValidateOnly {
+            if bZDB.BulkLoad {
+                err = bZDB.LoadRows(toTable, columns, page)
                 if err != nil {
-                    return err
+                    log.WithFields(log.Fields{
+                        "func": "ZabbixDB.SyncHistoryItem",
+                        "step": "bulk.load",
+                    }).Warnf("bulk load %s itemid [%d] is failed, fall back to insert: %s", toTable, mapItemid, err)
                 }
-
-                if isEmpty {
-                    break
+            }
+            if !bZDB.BulkLoad || err != nil {
+                err = bZDB.InsertRows(sql2, "", len(columns), page)
+                if err != nil {
+                    return iCount, err
                 }
-
-                limitStart += limitOffset
             }
+            bZDB.TimescaleProgress.Add(toTable, columns, page)
+        }
+        iCount += len(page)
+        if db.Checkpoint != nil {
+            err = db.Checkpoint.Save(NewCheckpointEntry(hTable, window, 0, itemid, lastClock, lastNs, false))
+            if err != nil {
+                return iCount, err
+            }
+        }
+        if last {
+            break
         }
     }
-    return nil
+
+    if db.Checkpoint != nil {
+        err := db.Checkpoint.Save(NewCheckpointEntry(hTable, window, 0, itemid, lastClock, lastNs, true))
+        if err != nil {
+            return iCount, err
+        }
+    }
+    return iCount, nil
 }
 
-func (db *ZabbixDB) SyncTrendsToOne(bZDB *ZabbixDB, tTable string, hostid int, host string, ignoreErr bool) error {
+func (db *ZabbixDB) SyncTrendsToOne(bZDB *ZabbixDB, tTable string, hostid int, host string, window SyncWindow, ignoreErr bool) error {
     var err error
 
+    if db.Checkpoint != nil && !db.Follow && db.Checkpoint.HostDone(tTable, window, hostid) {
+        log.WithFields(log.Fields{
+            "func": "ZabbixDB.SyncTrendsToOne",
+            "step": "checkpoint",
+        }).Debugf("skip %s hostid [%d], already done in checkpoint", tTable, hostid)
+        return nil
+    }
+
     aHostid := hostid
     aHost := host
     aItemList, err := db.GetItemList(aHostid)
@@ -408,52 +755,44 @@ func (db *ZabbixDB) SyncTrendsToOne(bZDB *ZabbixDB, tTable string, hostid int, h
         return err
     }
 
-    mappingI, err := bZDB.MappingItemId(aHost, aItemMap)
+    mapping, err := bZDB.MappingItemId(aHost, aItemMap)
     if err != nil {
         return err
     }
+    mappingI := mapping.Itemids
 
-    sql1 := fmt.Sprintf("select * from %s where itemid = ?", tTable)
-    var sql2 string
-    switch bZDB.DBDriver {
-    case "mysql":
-        sql2 = fmt.Sprintf(
-            "insert into %s values(?, ?, ?, ?, ?, ?) on duplicate key update num=?, value_min=?, value_avg=?, value_max=?", 
-            tTable,
-        )
-    case "postgres":
-        sql2 = fmt.Sprintf(`insert into %s values($1, $2, $3, $4, $5, $6) 
-            on conflict(itemid, clock) do update
-            set
-              num = $7,
-              value_min = $8,
-              value_avg = $9,
-              value_max = $10`, 
-            tTable,
-        )
-    }
-
+    hasFailed := false
     for _, itemid := range aItemList {
         log.WithFields(log.Fields{
             "func": "ZabbixDB.SyncTrendsToOne",
             "step": "insert",
-        }).Tracef("prepare sql [%s] hostid [%d] itemid [%d] mapItemid [%d]", sql1, aHostid, itemid, mappingI[itemid])
+        }).Tracef("prepare sql hostid [%d] itemid [%d] mapItemid [%d]", aHostid, itemid, mappingI[itemid])
 
-        if val, ok := mappingI[itemid]; !ok || val == 0 {
+        if _, ok := mappingI[itemid]; !ok {
             log.WithFields(log.Fields{
                 "func": "ZabbixDB.SyncTrendsToOne",
                 "step": "insert",
-            }).Errorf("not found itemid mapping for itemid [%d]", itemid)
+            }).Errorf("not found itemid mapping for itemid [%d] key [%s]", itemid, mapping.Unmapped[itemid])
             continue
         }
 
-        aRows, err := db.DB.Query(sql1, itemid)
+        toTable := mapping.TargetTable(tTable, itemid)
+        if toTable == "" {
+            log.WithFields(log.Fields{
+                "func": "ZabbixDB.SyncTrendsToOne",
+                "step": "value.type",
+            }).Infof("mapItemid [%d] of itemid [%d] is not numeric on new zabbix, skip %s", mappingI[itemid], itemid, tTable)
+            continue
+        }
+
+        iCount, err := db.SyncTrendsItem(bZDB, tTable, toTable, itemid, mappingI[itemid], window)
         if err != nil {
+            log.WithFields(log.Fields{
+                "func": "ZabbixDB.SyncTrendsToOne",
+                "step": "insert",
+            }).Errorf("try to sync %s hostid [%d] itemid [%d] mapItemid [%d] is failed", tTable, aHostid, itemid, mappingI[itemid])
             if ignoreErr {
-                log.WithFields(log.Fields{
-                    "func": "ZabbixDB.SyncTrendsToOne",
-                    "step": "insert",
-                }).Error(err)
+                hasFailed = true
                 log.WithFields(log.Fields{
                     "func": "ZabbixDB.SyncTrendsToOne",
                     "step": "insert",
@@ -462,38 +801,6 @@ func (db *ZabbixDB) SyncTrendsToOne(bZDB *ZabbixDB, tTable string, hostid int, h
             }
             return err
         }
-        defer aRows.Close()
-
-        iCount := 0
-        for aRows.Next() {
-            var _itemid int
-            var _clock int
-            var _num int
-            var _value_min string
-            var _value_avg string
-            var _value_max string
-            aRows.Scan(&_itemid, &_clock, &_num, &_value_min, &_value_avg, &_value_max)
-            _, err := bZDB.DB.Exec(
-                sql2, 
-                mappingI[itemid], _clock, _num, _value_min, _value_avg, _value_max,
-                _num, _value_min, _value_avg, _value_max,
-            )
-            if err != nil {
-                log.WithFields(log.Fields{
-                    "func": "ZabbixDB.SyncTrendsToOne",
-                    "step": "insert",
-                }).Errorf("try to sync %s hostid [%d] itemid [%d] mapItemid [%d] is failed", tTable, aHostid, itemid, mappingI[itemid])
-                if ignoreErr {
-                    log.WithFields(log.Fields{
-                        "func": "ZabbixDB.SyncTrendsToOne",
-                        "step": "insert",
-                    }).Info("ignore error ...")
-                    break
-                }
-                return err
-            }
-            iCount++
-        }
 
         log.WithFields(log.Fields{
             "func": "ZabbixDB.SyncTrendsToOne",
@@ -501,5 +808,170 @@ func (db *ZabbixDB) SyncTrendsToOne(bZDB *ZabbixDB, tTable string, hostid int, h
         }).Tracef("done sync %s hostid [%d] itemid [%d] mapItemid [%d], insert count is %d", tTable, aHostid, itemid, mappingI[itemid], iCount)
 
     }
+
+    if db.Checkpoint != nil && !hasFailed {
+        return db.Checkpoint.SaveHost(tTable, window, aHostid)
+    }
     return nil
-}
\ No newline at end of file
+}
+
+// TrendsUpsert is the suffix of a trends insert to update the existing hour.
+func (db *ZabbixDB) TrendsUpsert() string {
+    switch db.DBDriver {
+    case "mysql":
+        return " on duplicate key update num=values(num), value_min=values(value_min), value_avg=values(value_avg), value_max=values(value_max)"
+    case "postgres":
+        return ` on conflict(itemid, clock) do update
+            set
+              num = excluded.num,
+              value_min = excluded.value_min,
+              value_avg = excluded.value_avg,
+              value_max = excluded.value_max`
+    }
+    return ""
+}
+
+// SyncTrendsItem upserts the trends of one item inside of the window into
+// mapItemid of toTable on bZDB and returns the count of written rows.
+func (db *ZabbixDB) SyncTrendsItem(bZDB *ZabbixDB, tTable string, toTable string, itemid int, mapItemid int, window SyncWindow) (int, error) {
+    beginClock, endClock := window.Bounds()
+    if db.Checkpoint != nil {
+        if entry, ok := db.Checkpoint.Item(tTable, window, itemid); ok {
+            if entry.Done && !db.Follow {
+                return 0, nil
+            }
+            // the trends of the last hour are still updated, so take it again
+            if int64(entry.Clock) > beginClock {
+                beginClock = int64(entry.Clock)
+            }
+        }
+    }
+
+    conv, err := bZDB.NewTableConverter(tTable, toTable)
+    if err != nil {
+        return 0, err
+    }
+    defer conv.Report(itemid)
+
+    columns := conv.Columns()
+    clockIdx := conv.Index("clock")
+    sql1 := fmt.Sprintf("select %s from %s where itemid = ? and clock >= ? and clock < ?", strings.Join(conv.SourceColumns(), ", "), tTable)
+    sql2 := fmt.Sprintf("insert into %s (%s) values ", toTable, strings.Join(columns, ", "))
+    sql3 := bZDB.TrendsUpsert()
+
+    log.WithFields(log.Fields{
+        "func": "ZabbixDB.SyncTrendsItem",
+        "step": "select.sql",
+    }).Tracef("prepare sql [%s] itemid [%d] mapItemid [%d]", sql1, itemid, mapItemid)
+
+    aRows, err := db.Query(sql1, itemid, beginClock, endClock)
+    if err != nil {
+        return 0, err
+    }
+    defer aRows.Close()
+
+    rows := make([][]interface{}, 0)
+    lastClock := 0
+    for aRows.Next() {
+        args := conv.ScanArgs()
+        err = aRows.Scan(args...)
+        if err != nil {
+            return 0, err
+        }
+        if _clock := int(args[clockIdx].(*sql.NullInt64).Int64); _clock > lastClock {
+            lastClock = _clock
+        }
+        if row, ok := conv.Convert(args, mapItemid); ok {
+            rows = append(rows, row)
+        }
+    }
+    err = aRows.Err()
+    if err != nil {
+        return 0, err
+    }
+    if len(rows) == 0 {
+        return 0, nil
+    }
+
+    if !bZDB.ValidateOnly {
+        err = bZDB.InsertRows(sql2, sql3, len(columns), rows)
+        if err != nil {
+            return 0, err
+        }
+        bZDB.TimescaleProgress.Add(toTable, columns, rows)
+    }
+    if db.Checkpoint != nil {
+        err = db.Checkpoint.Save(NewCheckpointEntry(tTable, window, 0, itemid, lastClock, 0, true))
+        if err != nil {
+            return len(rows), err
+        }
+    }
+    return len(rows), nil
+}
+
+// Placeholders returns the values list for a multi-row insert of rows x cols
+// in the placeholder style of the driver.
+func (db *ZabbixDB) Placeholders(rows int, cols int) string {
+    var b strings.Builder
+    n := 1
+    for r := 0; r < rows; r++ {
+        if r > 0 {
+            b.WriteString(", ")
+        }
+        b.WriteString("(")
+        for c := 0; c < cols; c++ {
+            if c > 0 {
+                b.WriteString(", ")
+            }
+            if db.DBDriver == "postgres" {
+                fmt.Fprintf(&b, "$%d", n)
+            } else {
+                b.WriteString("?")
+            }
+            n++
+        }
+        b.WriteString(")")
+    }
+    return b.String()
+}
+
+// insertBatch returns the BatchSize clamped to the rows of cols columns that
+// fit in MaxPlaceholders.
+func (db *ZabbixDB) insertBatch(cols int) int {
+    batchSize := db.BatchSize
+    if batchSize <= 0 {
+        batchSize = DefaultBatchSize
+    }
+    if cols > 0 && batchSize*cols > MaxPlaceholders {
+        batchSize = MaxPlaceholders / cols
+    }
+    return batchSize
+}
+
+// InsertRows writes rows as multi-row inserts of BatchSize rows each, all of
+// them in one transaction, prefix is the statement before the values list and
+// suffix the part after it. Batches over MaxPlaceholders are split smaller.
+func (db *ZabbixDB) InsertRows(prefix string, suffix string, cols int, rows [][]interface{}) error {
+    batchSize := db.insertBatch(cols)
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return err
+    }
+    for start := 0; start < len(rows); start += batchSize {
+        end := start + batchSize
+        if end > len(rows) {
+            end = len(rows)
+        }
+        args := make([]interface{}, 0, (end-start)*cols)
+        for _, row := range rows[start:end] {
+            args = append(args, row...)
+        }
+        _, err = tx.Exec(prefix+db.Placeholders(end-start, cols)+suffix, args...)
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    return tx.Commit()
+}
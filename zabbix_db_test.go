@@ -1,8 +1,16 @@
 package main
 
 import (
+    "context"
+    "database/sql"
+    "errors"
+    "io/ioutil"
     "log"
+    "os"
+    "path/filepath"
+    "strings"
     "testing"
+    "time"
     // "fmt"
 )
 
@@ -16,7 +24,7 @@ func GetAPIA() (*ZabbixAPI, error) {
         "Admin",
         "zabbix",
     )
-    _, err := api.Login()
+    _, err := api.Login(context.Background())
     return api, err
 }
 
@@ -26,7 +34,7 @@ func GetAPIB() (*ZabbixAPI, error) {
         "Admin",
         "zabbix",
     )
-    _, err := api.Login()
+    _, err := api.Login(context.Background())
     return api, err
 }
 
@@ -53,7 +61,7 @@ func TestGetTemplateList(t *testing.T) {
 func TestCleanNewTemplate(t *testing.T) {
     zdb, _ := GetDBConnectB()
     zapi, _ := GetAPIB()
-    err := CleanNewTemplate(zapi, zdb)
+    err := CleanNewTemplate(context.Background(), zapi, zdb)
     if err != nil {
         log.Println(err)
     }
@@ -63,7 +71,7 @@ func TestCleanNewTemplate(t *testing.T) {
 //     zapiA, _ := GetAPIA()
 //     zapiB, _ := GetAPIB()
 
-//     err := CreateNewTemplate(zapiA, zapiB)
+//     err := CreateNewTemplate(context.Background(), zapiA, zapiB)
 //     if err != nil {
 //         log.Println(err)
 //     }
@@ -74,7 +82,7 @@ func TestCleanNewTemplate(t *testing.T) {
 //     zapiB, _ := GetAPIB()
 //     zdbA, _ := GetDBConnectA()
 
-//     err := CreateNewHost(zapiA, zdbA, zapiB, "", 0)
+//     err := CreateNewHost(context.Background(), zapiA, zdbA, zapiB, "", 0)
 //     if err != nil {
 //         log.Println(err)
 //     }
@@ -108,7 +116,7 @@ func TestSyncHistoryToOne(t *testing.T) {
     zdbA, _ := GetDBConnectA()
     zbxB, _ := GetDBConnectB()
 
-    err := zdbA.SyncHistoryToOne(zbxB, "history_text", 10266, "192.168.52.61_midware")
+    err := zdbA.SyncHistoryToOne(zbxB, "history_text", 10266, "192.168.52.61_midware", SyncWindow{}, false)
     log.Println(err)
 }
 
@@ -116,7 +124,7 @@ func TestSyncTrendsToOne(t *testing.T) {
     zdbA, _ := GetDBConnectA()
     zbxB, _ := GetDBConnectB()
 
-    err := zdbA.SyncTrendsToOne(zbxB, "trends", 10266, "192.168.52.61_midware")
+    err := zdbA.SyncTrendsToOne(zbxB, "trends", 10266, "192.168.52.61_midware", SyncWindow{}, false)
     log.Println(err)
 }
 
@@ -163,13 +171,259 @@ func TestDiffUnitList(t *testing.T) {
 
 func TestSortTemplateDepend(t *testing.T) {
     zapiA, err := GetAPIA()
-    res, err := SortTemplateDepend(zapiA)
+    res, err := SortTemplateDepend(context.Background(), zapiA)
     log.Println(err)
     log.Println(res)
 }
 
 func TestCheckHost(t *testing.T) {
     zapiA, err := GetAPIA()
-    _, err = CheckHost(zapiA, zapiA, "Linux servers")
+    _, err = CheckHost(context.Background(), zapiA, zapiA, "Linux servers")
     log.Println(err)
-}
\ No newline at end of file
+}
+
+func TestPlaceholders(t *testing.T) {
+    mdb := &ZabbixDB{DBDriver: "mysql"}
+    if res := mdb.Placeholders(2, 3); res != "(?, ?, ?), (?, ?, ?)" {
+        t.Fatalf("unexpected mysql placeholders: %s", res)
+    }
+    pdb := &ZabbixDB{DBDriver: "postgres"}
+    if res := pdb.Placeholders(2, 2); res != "($1, $2), ($3, $4)" {
+        t.Fatalf("unexpected postgres placeholders: %s", res)
+    }
+    pdb.BatchSize = 10000
+    if res := pdb.insertBatch(8); res != MaxPlaceholders/8 {
+        t.Fatalf("unexpected batch of 8 columns: %d", res)
+    }
+    if res := pdb.insertBatch(2); res != 10000 {
+        t.Fatalf("unexpected batch of 2 columns: %d", res)
+    }
+}
+
+func TestParseSyncTime(t *testing.T) {
+    now := time.Unix(1600000000, 0)
+    cases := map[string]int64{
+        "": 0,
+        "1500000000": 1500000000,
+        "2d": now.AddDate(0, 0, -2).Unix(),
+        "36h": 1600000000 - 36*3600,
+        "2020-09-13": time.Date(2020, 9, 13, 0, 0, 0, 0, time.Local).Unix(),
+        "2020-09-13T12:26:40Z": 1600000000,
+    }
+    for in, expect := range cases {
+        res, err := ParseSyncTime(in, now)
+        if err != nil || res != expect {
+            t.Fatalf("parse sync time [%s] expect %d, got %d %v", in, expect, res, err)
+        }
+    }
+    if _, err := ParseSyncTime("yesterday", now); err == nil {
+        t.Fatal("expect error for unknown sync time")
+    }
+}
+
+func TestSyncFollow(t *testing.T) {
+    dir, err := ioutil.TempDir("", "zabbix_migrate")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "zabbix_migrate.checkpoint")
+    cp, err := OpenCheckpoint(path, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cp.Close()
+
+    stopCh := make(chan struct{})
+    count := 0
+    err = SyncFollow(time.Millisecond, stopCh, cp, func() error {
+        count++
+        // the same item moves on every pass
+        cp.Save(NewCheckpointEntry("history", SyncWindow{}, 0, 100, 1600000000+count, 0, true))
+        if count == 2 {
+            return errors.New("db is gone for a while")
+        }
+        if count == 3 {
+            close(stopCh)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 4 {
+        t.Fatalf("expect 3 passes and the last one, got %d", count)
+    }
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // compacted before the last pass, which appends one line
+    if lines := strings.Count(string(buf), "\n"); lines != 2 {
+        t.Errorf("expect 2 lines in followed checkpoint, got %d: %s", lines, buf)
+    }
+
+    stopCh = make(chan struct{})
+    close(stopCh)
+    err = SyncFollow(time.Millisecond, stopCh, nil, func() error {
+        return errors.New("db is gone")
+    })
+    if err == nil {
+        t.Error("failed last pass is not returned")
+    }
+}
+
+func TestRebind(t *testing.T) {
+    pdb := &ZabbixDB{DBDriver: "postgres"}
+    res := pdb.Rebind("select itemid from items where hostid = ? and key_ = 'a?b' and flags = ?")
+    if res != "select itemid from items where hostid = $1 and key_ = 'a?b' and flags = $2" {
+        t.Fatalf("unexpected rebind for postgres: %s", res)
+    }
+    mdb := &ZabbixDB{DBDriver: "mysql"}
+    if res := mdb.Rebind("select 1 from hosts where hostid = ?"); res != "select 1 from hosts where hostid = ?" {
+        t.Fatalf("unexpected rebind for mysql: %s", res)
+    }
+}
+
+// GetDBConnectPG prepares a minimal zabbix schema on a local postgres.
+func GetDBConnectPG() (*ZabbixDB, error) {
+    db, err := sql.Open("postgres", "host=127.0.0.1 port=5432 user=zabbix password=zabbix dbname=zabbix_test sslmode=disable")
+    if err != nil {
+        return nil, err
+    }
+    defer db.Close()
+    if err := db.Ping(); err != nil {
+        return nil, err
+    }
+
+    stmts := []string{
+        "drop table if exists dbversion, hstgrp, hosts, hosts_groups, items, history, history_uint",
+        "create table dbversion (mandatory integer, optional integer)",
+        "insert into dbversion values (5000000, 5000000)",
+        "create table hstgrp (groupid bigint primary key, name varchar(255))",
+        "create table hosts (hostid bigint primary key, host varchar(128), status integer)",
+        "create table hosts_groups (hostgroupid bigint primary key, hostid bigint, groupid bigint)",
+        "create table items (itemid bigint primary key, hostid bigint, key_ varchar(2048), value_type integer, flags integer)",
+        "create table history (itemid bigint, clock integer, value numeric(16,4), ns integer)",
+        "create table history_uint (itemid bigint, clock integer, value numeric(20,0), ns integer)",
+        "insert into hstgrp values (2, 'Linux servers')",
+        "insert into hosts values (10084, 'Zabbix server', 0), (10085, 'new server', 0)",
+        "insert into hosts_groups values (1, 10084, 2)",
+        `insert into items values (100, 10084, 'vfs.file.regmatch["/etc/x","it''s"]', 0, 0), (200, 10085, 'vfs.file.regmatch["/etc/x","it''s"]', 0, 0)`,
+        // the value_type of proc.num is changed from uint to float on the new host
+        "insert into items values (101, 10084, 'proc.num', 3, 0), (201, 10085, 'proc.num', 0, 0)",
+        "insert into history values (100, 1600000000, 1.5, 0), (100, 1600000000, 2.5, 10), (100, 1600000060, 3.5, 0)",
+        // history before zabbix 6.0 has no primary key, rows can share (clock, ns)
+        "insert into history values (102, 1600000000, 1, 0), (102, 1600000000, 2, 0), (102, 1600000000, 3, 0), (102, 1600000060, 4, 0)",
+        "insert into history_uint values (101, 1600000000, 42, 0), (101, 1600000060, 43, 0)",
+    }
+    for _, stmt := range stmts {
+        if _, err := db.Exec(stmt); err != nil {
+            return nil, err
+        }
+    }
+    return NewZabbixDB("postgres", "127.0.0.1", 5432, "zabbix", "zabbix", "zabbix_test")
+}
+
+func TestPostgresReadQueries(t *testing.T) {
+    zdb, err := GetDBConnectPG()
+    if err != nil {
+        t.Skipf("local postgres is not ready: %s", err)
+    }
+    defer zdb.Close()
+
+    hostList, err := zdb.GetHostList("Linux servers", 0)
+    if err != nil || len(hostList) != 1 || hostList[0] != 10084 {
+        t.Fatalf("unexpected host list %v: %v", hostList, err)
+    }
+    hMapList, err := zdb.GetHostMapList("", 10085, 0)
+    if err != nil || len(hMapList) != 1 || hMapList[0][10085] != "new server" {
+        t.Fatalf("unexpected host map list %v: %v", hMapList, err)
+    }
+    // zabbix before 5.4 has no item_tag table
+    tags, err := zdb.GetItemTags(10084)
+    if err != nil || len(tags) != 0 {
+        t.Fatalf("unexpected item tags without item_tag table %v: %v", tags, err)
+    }
+    itemList, err := zdb.GetItemList(10084)
+    if err != nil || len(itemList) != 2 {
+        t.Fatalf("unexpected item list %v: %v", itemList, err)
+    }
+    iMap, err := zdb.GetItemMap(10084)
+    if err != nil {
+        t.Fatal(err)
+    }
+    mapping, err := zdb.MappingItemId("new server", iMap)
+    if err != nil || mapping.Itemids[100] != 200 || mapping.Itemids[101] != 201 || len(mapping.Unmapped) != 0 {
+        t.Fatalf("unexpected item mapping %v: %v", mapping, err)
+    }
+    if mapping.ValueTypes[100] != ValueTypeFloat || mapping.ValueTypes[101] != ValueTypeFloat {
+        t.Fatalf("unexpected value types of mapping: %v", mapping.ValueTypes)
+    }
+    if res := mapping.TargetTable("history", 100); res != "history" {
+        t.Fatalf("unexpected target table of float item: %s", res)
+    }
+    if res := mapping.TargetTable("history_uint", 101); res != "history" {
+        t.Fatalf("unexpected target table of uint item changed to float: %s", res)
+    }
+    if res := mapping.TargetTable("trends_uint", 101); res != "trends" {
+        t.Fatalf("unexpected target trends table of uint item changed to float: %s", res)
+    }
+
+    count, err := zdb.SyncHistoryItem(zdb, "history", "history", 100, 200, SyncWindow{})
+    if err != nil || count != 3 {
+        t.Fatalf("unexpected history sync count %d: %v", count, err)
+    }
+    count, err = zdb.SyncHistoryItem(zdb, "history_uint", mapping.TargetTable("history_uint", 101), 101, 201, SyncWindow{})
+    if err != nil || count != 2 {
+        t.Fatalf("unexpected routed history sync count %d: %v", count, err)
+    }
+    var routed int
+    err = zdb.QueryRow("select count(*) from history where itemid = ?", 201).Scan(&routed)
+    if err != nil || routed != 2 {
+        t.Fatalf("expect 2 rows of itemid 201 in history, got %d: %v", routed, err)
+    }
+
+    // the rows of the same (clock, ns) cross the page boundary
+    historyPageRows = 2
+    defer func() { historyPageRows = 1000 }()
+    count, err = zdb.SyncHistoryItem(zdb, "history", "history", 102, 202, SyncWindow{})
+    if err != nil || count != 4 {
+        t.Fatalf("unexpected history sync count %d of rows with the same clock and ns: %v", count, err)
+    }
+
+    // an import goes on after the records written before a crash
+    dir, err := ioutil.TempDir("", "zabbix_import")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    w, err := NewExportWriter(dir, "history", ExportFormatNDJSON, 10084, "Zabbix server", 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 3; i++ {
+        err = w.Write(`vfs.file.regmatch["/etc/x","it's"]`, []interface{}{int64(100), int64(1700000000 + i), 1.5, int64(0)})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := w.Close(); err != nil || len(w.Files) != 1 {
+        t.Fatalf("unexpected export files %v: %v", w.Files, err)
+    }
+    cp, err := OpenCheckpoint(filepath.Join(dir, "zabbix_migrate.checkpoint"), false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cp.Close()
+    importFlushRows = 1
+    defer func() { importFlushRows = 10000 }()
+    cp.Save(NewCheckpointEntry("import:a", SyncWindow{}, 0, 0, 2, 0, false))
+    count, err = zdb.ImportFile(w.Files[0], SyncWindow{}, cp, "import:a")
+    if err != nil || count != 1 {
+        t.Fatalf("unexpected resumed import count %d: %v", count, err)
+    }
+    if entry, ok := cp.Host("import:a", SyncWindow{}, 0); !ok || entry.Clock != 3 {
+        t.Fatalf("unexpected import checkpoint %v", entry)
+    }
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// ElasticIndices is the index of zabbix in elasticsearch for the history table.
+var ElasticIndices = map[string]string{
+    "history": "dbl",
+    "history_str": "str",
+    "history_log": "log",
+    "history_uint": "uint",
+    "history_text": "text",
+}
+
+// ElasticHistory is the history of zabbix stored in elasticsearch like the
+// HistoryStorageURL, HistoryStorageTypes and HistoryStorageDateIndex of the
+// zabbix server, the tables of the other types stay in the database.
+type ElasticHistory struct {
+    URL         string
+    Types       map[string]bool
+    DateIndex   bool
+    Client      *http.Client
+    Retries     int
+}
+
+// NewElasticHistory takes the types as comma separated indices, empty for all.
+func NewElasticHistory(url string, types string, dateIndex bool) (*ElasticHistory, error) {
+    res := &ElasticHistory{
+        URL: strings.TrimRight(url, "/"),
+        Types: make(map[string]bool),
+        DateIndex: dateIndex,
+        Client: &http.Client{
+            Timeout: 60 * time.Second,
+        },
+        Retries: 3,
+    }
+    if strings.TrimSpace(types) == "" {
+        types = "uint,dbl,str,log,text"
+    }
+    valid := make(map[string]bool)
+    for _, index := range ElasticIndices {
+        valid[index] = true
+    }
+    for _, index := range strings.Split(types, ",") {
+        index = strings.TrimSpace(index)
+        if !valid[index] {
+            return nil, fmt.Errorf("cannot support the history storage type %s, support for uint|dbl|str|log|text", index)
+        }
+        res.Types[index] = true
+    }
+    return res, nil
+}
+
+// Index returns the index of the table when it is stored in elasticsearch.
+func (e *ElasticHistory) Index(table string) (string, bool) {
+    if e == nil {
+        return "", false
+    }
+    index, ok := ElasticIndices[table]
+    if !ok || !e.Types[index] {
+        return "", false
+    }
+    return index, true
+}
+
+// DocIndex returns the index of a document by its clock, zabbix appends the
+// date of the clock to the index with HistoryStorageDateIndex.
+func (e *ElasticHistory) DocIndex(index string, clock int64) string {
+    if !e.DateIndex {
+        return index
+    }
+    return index + "-" + time.Unix(clock, 0).UTC().Format("2006-01-02")
+}
+
+func (e *ElasticHistory) request(method string, path string, body []byte, res interface{}) error {
+    var rsp *http.Response
+    err := retryCall(context.Background(), fmt.Sprintf("request %s to elasticsearch", path), e.Retries, DefaultRetryWait, func() (bool, error) {
+        req, err := http.NewRequest(method, e.URL+path, bytes.NewReader(body))
+        if err != nil {
+            return false, err
+        }
+        req.Header.Set("Content-Type", "application/json")
+        if strings.HasSuffix(path, "_bulk") {
+            req.Header.Set("Content-Type", "application/x-ndjson")
+        }
+        rsp, err = e.Client.Do(req)
+        if err != nil {
+            return true, err
+        }
+        if retryStatus(rsp.StatusCode) {
+            rsp.Body.Close()
+            return true, fmt.Errorf("elasticsearch status %s", rsp.Status)
+        }
+        return false, nil
+    })
+    if err != nil {
+        return err
+    }
+    defer rsp.Body.Close()
+
+    if rsp.StatusCode/100 != 2 {
+        var msg bytes.Buffer
+        msg.ReadFrom(rsp.Body)
+        if msg.Len() > 512 {
+            msg.Truncate(512)
+        }
+        return fmt.Errorf("elasticsearch status %s: %s", rsp.Status, strings.TrimSpace(msg.String()))
+    }
+    decoder := json.NewDecoder(rsp.Body)
+    decoder.UseNumber()
+    return decoder.Decode(res)
+}
+
+// Search reads the documents of the item after the (lastClock, lastNs) and
+// before the endClock in order of clock and ns, like the keyset of the
+// history tables. The values of the columns are returned as strings for
+// RowConverter.SetArgs.
+func (e *ElasticHistory) Search(index string, columns []string, itemid int, endClock int64, lastClock int, lastNs int, size int) ([]map[string]string, error) {
+    query := map[string]interface{}{
+        "size": size,
+        "_source": columns,
+        "sort": []interface{}{
+            map[string]string{"clock": "asc"},
+            map[string]string{"ns": "asc"},
+        },
+        "query": map[string]interface{}{
+            "bool": map[string]interface{}{
+                "filter": []interface{}{
+                    map[string]interface{}{"term": map[string]interface{}{"itemid": itemid}},
+                    map[string]interface{}{"range": map[string]interface{}{"clock": map[string]interface{}{"lt": endClock}}},
+                    map[string]interface{}{"bool": map[string]interface{}{
+                        "minimum_should_match": 1,
+                        "should": []interface{}{
+                            map[string]interface{}{"range": map[string]interface{}{"clock": map[string]interface{}{"gt": lastClock}}},
+                            map[string]interface{}{"bool": map[string]interface{}{
+                                "filter": []interface{}{
+                                    map[string]interface{}{"term": map[string]interface{}{"clock": lastClock}},
+                                    map[string]interface{}{"range": map[string]interface{}{"ns": map[string]interface{}{"gt": lastNs}}},
+                                },
+                            }},
+                        },
+                    }},
+                },
+            },
+        },
+    }
+    body, err := json.Marshal(query)
+    if err != nil {
+        return nil, err
+    }
+
+    var res struct {
+        Hits struct {
+            Hits []struct {
+                Source  map[string]interface{} `json:"_source"`
+            } `json:"hits"`
+        } `json:"hits"`
+    }
+    // the wildcard takes the indices by date as well
+    err = e.request("POST", "/"+index+"*/_search?ignore_unavailable=true", body, &res)
+    if err != nil {
+        return nil, err
+    }
+
+    docs := make([]map[string]string, 0, len(res.Hits.Hits))
+    for _, hit := range res.Hits.Hits {
+        doc := make(map[string]string)
+        for name, v := range hit.Source {
+            switch v := v.(type) {
+            case nil:
+            case string:
+                doc[name] = v
+            default:
+                doc[name] = fmt.Sprint(v)
+            }
+        }
+        docs = append(docs, doc)
+    }
+    return docs, nil
+}
+
+// Bulk indexes the rows of the columns by the bulk api, uint values keep
+// their digits over the float precision. The documents get the id
+// <itemid>-<clock>-<ns>, so a bulk retried after it was applied indexes them
+// again in place instead of twice.
+func (e *ElasticHistory) Bulk(index string, columns []string, rows [][]interface{}) error {
+    itemidIdx, clockIdx, nsIdx := -1, -1, -1
+    for idx, name := range columns {
+        switch name {
+        case "itemid":
+            itemidIdx = idx
+        case "clock":
+            clockIdx = idx
+        case "ns":
+            nsIdx = idx
+        }
+    }
+    if itemidIdx < 0 || clockIdx < 0 {
+        return fmt.Errorf("bulk index into %s needs the itemid and clock columns", index)
+    }
+
+    var body bytes.Buffer
+    encoder := json.NewEncoder(&body)
+    for _, row := range rows {
+        clock, ok := row[clockIdx].(int64)
+        if !ok {
+            return fmt.Errorf("bulk index into %s needs int64 clock, got %T", index, row[clockIdx])
+        }
+        id := fmt.Sprintf("%v-%d", row[itemidIdx], clock)
+        if nsIdx >= 0 {
+            id += fmt.Sprintf("-%v", row[nsIdx])
+        }
+        err := encoder.Encode(map[string]interface{}{"index": map[string]string{"_index": e.DocIndex(index, clock), "_id": id}})
+        if err != nil {
+            return err
+        }
+        doc := make(map[string]interface{})
+        for idx, name := range columns {
+            v := row[idx]
+            if s, ok := v.(string); ok && index == "uint" && name == "value" {
+                v = json.Number(s)
+            }
+            doc[name] = v
+        }
+        err = encoder.Encode(doc)
+        if err != nil {
+            return err
+        }
+    }
+
+    var res struct {
+        Errors  bool    `json:"errors"`
+        Items   []map[string]struct {
+            Status  int             `json:"status"`
+            Error   interface{}     `json:"error"`
+        } `json:"items"`
+    }
+    err := e.request("POST", "/_bulk", body.Bytes(), &res)
+    if err != nil {
+        return err
+    }
+    if !res.Errors {
+        return nil
+    }
+    failed := 0
+    var first interface{}
+    for _, item := range res.Items {
+        for _, result := range item {
+            if result.Error != nil {
+                if first == nil {
+                    first = result.Error
+                }
+                failed++
+            }
+        }
+    }
+    return fmt.Errorf("bulk index into %s failed for %d of %d documents: %v", index, failed, len(rows), first)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestElasticHistory(t *testing.T) {
+    var bulk string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        buf, _ := ioutil.ReadAll(r.Body)
+        switch r.URL.Path {
+        case "/uint*/_search":
+            if !strings.Contains(string(buf), `{"term":{"itemid":42}}`) {
+                t.Errorf("search body = %s", buf)
+            }
+            w.Write([]byte(`{"hits":{"hits":[{"_source":{"itemid":42,"clock":1600000000,"ns":5,"value":18446744073709551615}}]}}`))
+        case "/_bulk":
+            bulk = string(buf)
+            w.Write([]byte(`{"errors":false,"items":[]}`))
+        default:
+            t.Errorf("unexpected path %s", r.URL.Path)
+            w.WriteHeader(http.StatusNotFound)
+        }
+    }))
+    defer srv.Close()
+
+    if _, err := NewElasticHistory(srv.URL, "uint,float", false); err == nil {
+        t.Error("unknown history storage type is accepted")
+    }
+    e, err := NewElasticHistory(srv.URL+"/", "uint, text", true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := e.Index("history"); ok {
+        t.Error("dbl is not stored in elasticsearch")
+    }
+    if index, ok := e.Index("history_uint"); !ok || index != "uint" {
+        t.Errorf("index = %s, %v", index, ok)
+    }
+
+    docs, err := e.Search("uint", []string{"itemid", "clock", "value", "ns"}, 42, 1600003600, 1600000000, -1, 1000)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(docs) != 1 || docs[0]["value"] != "18446744073709551615" || docs[0]["ns"] != "5" {
+        t.Errorf("docs = %v", docs)
+    }
+
+    err = e.Bulk("uint", []string{"itemid", "clock", "value", "ns"}, [][]interface{}{
+        {int64(43), int64(1600000000), "18446744073709551615", int64(5)},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := `{"index":{"_id":"43-1600000000-5","_index":"uint-2020-09-13"}}` + "\n" + `{"clock":1600000000,"itemid":43,"ns":5,"value":18446744073709551615}` + "\n"
+    if bulk != want {
+        t.Errorf("bulk = %q, want %q", bulk, want)
+    }
+    err = e.Bulk("uint", []string{"itemid", "clock", "value", "ns"}, [][]interface{}{
+        {int64(43), "1600000000", "5", int64(5)},
+    })
+    if err == nil {
+        t.Error("string clock is accepted")
+    }
+}
@@ -0,0 +1,849 @@
+package main
+
+import (
+    "bufio"
+    "compress/gzip"
+    "database/sql"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    ExportFormatNDJSON      = "ndjson"
+    ExportFormatCSV         = "csv"
+    ExportFormatParquet     = "parquet"
+    ExportFormatRemoteWrite = "remote-write"
+    ExportFormatInflux      = "influx"
+)
+
+// HistoryWriter takes the rows of one table of one host for an export, Parts
+// counts the files or requests written.
+type HistoryWriter interface {
+    Write(key string, row []interface{}) error
+    Close() error
+    Parts() int
+}
+
+// DayWriter is a HistoryWriter partitioned by the day of the clock, its rows
+// come day by day and EndDay is called after each day, so only the part of
+// one day is kept open.
+type DayWriter interface {
+    HistoryWriter
+    EndDay() error
+}
+
+// NewHistoryWriter opens the writer of the table of a host, a nil writer
+// skips the table.
+type NewHistoryWriter func(table string, hostid int, host string) (HistoryWriter, error)
+
+// ExportWriterFor returns the writers of the format, files under dir for
+// ndjson or csv with chunkRows per file, parquet with batch rows per row
+// group, or requests of batch samples posted to the url for remote-write.
+// Influx line protocol is posted to the url when it is set, else written to
+// files.
+func ExportWriterFor(aZDB *ZabbixDB, format string, dir string, chunkRows int, url string, batch int) (NewHistoryWriter, error) {
+    switch format {
+    case ExportFormatNDJSON, ExportFormatCSV:
+        return func(table string, hostid int, host string) (HistoryWriter, error) {
+            return NewExportWriter(dir, table, format, hostid, host, chunkRows)
+        }, nil
+    case ExportFormatParquet:
+        return func(table string, hostid int, host string) (HistoryWriter, error) {
+            return NewParquetExportWriter(dir, table, hostid, host, batch)
+        }, nil
+    case ExportFormatRemoteWrite:
+        if url == "" {
+            return nil, errors.New("export to remote-write needs the url of the endpoint")
+        }
+        client := NewRemoteWriteClient(url)
+        return func(table string, hostid int, host string) (HistoryWriter, error) {
+            w, err := NewRemoteWriteExportWriter(aZDB, client, table, hostid, host, batch)
+            if w == nil {
+                return nil, err
+            }
+            return w, err
+        }, nil
+    case ExportFormatInflux:
+        var client *InfluxClient
+        if url != "" {
+            client = NewInfluxClient(url)
+        }
+        return func(table string, hostid int, host string) (HistoryWriter, error) {
+            return NewInfluxExportWriter(aZDB, client, dir, table, hostid, host, chunkRows, batch)
+        }, nil
+    }
+    return nil, fmt.Errorf("cannot support export for the format %s", format)
+}
+
+const DefaultExportChunk = 1000000
+
+// rows of an import are written in transactions of this size
+var importFlushRows = 10000
+
+var exportNameReplacer = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ExportWriter writes the rows of one table of one host into gzip files of
+// the format, a new file is started every ChunkRows rows. The files are laid
+// out as <dir>/<table>/<hostid>_<host>.<seq>.<format>.gz and every record
+// carries the host and key_ of its item instead of the itemid, so they can
+// be imported into a zabbix with other ids.
+type ExportWriter struct {
+    Dir         string
+    Table       string
+    Format      string
+    Hostid      int
+    Host        string
+    ChunkRows   int
+    Specs       []ColumnSpec
+    Files       []string
+
+    seq         int
+    rows        int
+    file        *os.File
+    gz          *gzip.Writer
+    buf         *bufio.Writer
+    csv         *csv.Writer
+}
+
+func NewExportWriter(dir string, table string, format string, hostid int, host string, chunkRows int) (*ExportWriter, error) {
+    specs, ok := TableSpecs[table]
+    if !ok {
+        return nil, fmt.Errorf("cannot support export for the table %s", table)
+    }
+    if format != ExportFormatNDJSON && format != ExportFormatCSV && format != ExportFormatInflux {
+        return nil, fmt.Errorf("cannot support export for the format %s", format)
+    }
+    return &ExportWriter{
+        Dir: dir,
+        Table: table,
+        Format: format,
+        Hostid: hostid,
+        Host: host,
+        ChunkRows: chunkRows,
+        // the itemid is replaced by host and key_
+        Specs: specs[1:],
+        Files: make([]string, 0),
+    }, nil
+}
+
+func (w *ExportWriter) header() []string {
+    res := []string{"host", "key_"}
+    for _, spec := range w.Specs {
+        res = append(res, spec.Name)
+    }
+    return res
+}
+
+func (w *ExportWriter) open() error {
+    err := w.Close()
+    if err != nil {
+        return err
+    }
+    name := fmt.Sprintf("%d_%s.%04d.%s.gz", w.Hostid, exportNameReplacer.ReplaceAllString(w.Host, "_"), w.seq, w.Format)
+    path := filepath.Join(w.Dir, w.Table, name)
+    err = os.MkdirAll(filepath.Dir(path), 0755)
+    if err != nil {
+        return err
+    }
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    w.seq++
+    w.rows = 0
+    w.file = file
+    w.gz = gzip.NewWriter(file)
+    w.buf = bufio.NewWriter(w.gz)
+    w.Files = append(w.Files, path)
+    if w.Format == ExportFormatCSV {
+        w.csv = csv.NewWriter(w.buf)
+        return w.csv.Write(w.header())
+    }
+    return nil
+}
+
+func (w *ExportWriter) next() error {
+    if w.file == nil || (w.ChunkRows > 0 && w.rows >= w.ChunkRows) {
+        err := w.open()
+        if err != nil {
+            return err
+        }
+    }
+    w.rows++
+    return nil
+}
+
+// WriteLine adds a line already in the format, like the line protocol.
+func (w *ExportWriter) WriteLine(line []byte) error {
+    err := w.next()
+    if err != nil {
+        return err
+    }
+    _, err = w.buf.Write(line)
+    return err
+}
+
+// Write adds the row converted from the table, its first column is the itemid.
+func (w *ExportWriter) Write(key string, row []interface{}) error {
+    err := w.next()
+    if err != nil {
+        return err
+    }
+
+    values := row[1:]
+    if w.Format == ExportFormatCSV {
+        record := []string{w.Host, key}
+        for _, v := range values {
+            record = append(record, exportString(v))
+        }
+        return w.csv.Write(record)
+    }
+
+    record := map[string]interface{}{"host": w.Host, "key_": key}
+    for idx, spec := range w.Specs {
+        if spec.Kind == ColumnUint {
+            // keep the digits of uint64 over the float precision
+            record[spec.Name] = json.Number(values[idx].(string))
+            continue
+        }
+        record[spec.Name] = values[idx]
+    }
+    line, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    _, err = w.buf.Write(append(line, '\n'))
+    return err
+}
+
+func (w *ExportWriter) Parts() int {
+    return len(w.Files)
+}
+
+func exportString(v interface{}) string {
+    switch v := v.(type) {
+    case int64:
+        return strconv.FormatInt(v, 10)
+    case float64:
+        return strconv.FormatFloat(v, 'g', -1, 64)
+    case string:
+        return v
+    }
+    return fmt.Sprint(v)
+}
+
+func (w *ExportWriter) Close() error {
+    if w.file == nil {
+        return nil
+    }
+    var err error
+    if w.csv != nil {
+        w.csv.Flush()
+        err = w.csv.Error()
+        w.csv = nil
+    }
+    if e := w.buf.Flush(); err == nil {
+        err = e
+    }
+    if e := w.gz.Close(); err == nil {
+        err = e
+    }
+    if e := w.file.Close(); err == nil {
+        err = e
+    }
+    w.file = nil
+    return err
+}
+
+// ExportItem writes the rows of one item of the table inside of the window,
+// history is paged by the (clock, ns) keyset like SyncHistoryItem.
+func (db *ZabbixDB) ExportItem(w HistoryWriter, table string, itemid int, key string, window SyncWindow) (int, error) {
+    conv, err := NewConverter(table, table, "", map[string]ColumnLimit{}, false)
+    if err != nil {
+        return 0, err
+    }
+    defer conv.Report(itemid)
+
+    limitOffset := 1000
+    columns := strings.Join(conv.SourceColumns(), ", ")
+    clockIdx := conv.Index("clock")
+    nsIdx := conv.Index("ns")
+    isTrends := nsIdx < 0
+    beginClock, endClock := window.Bounds()
+
+    eCount := 0
+    lastClock := int(beginClock)
+    lastNs := -1
+    for {
+        var rows *sql.Rows
+        if isTrends {
+            rows, err = db.Query(
+                fmt.Sprintf("select %s from %s where itemid = ? and clock >= ? and clock < ? order by clock", columns, table),
+                itemid, beginClock, endClock,
+            )
+        } else {
+            rows, err = db.Query(
+                fmt.Sprintf("select %s from %s where itemid = ? and clock < ? and clock >= ? and (clock > ? or ns > ?) order by clock, ns limit ?", columns, table),
+                itemid, endClock, lastClock, lastClock, lastNs, limitOffset,
+            )
+        }
+        if err != nil {
+            return eCount, err
+        }
+
+        read := 0
+        for rows.Next() {
+            args := conv.ScanArgs()
+            err = rows.Scan(args...)
+            if err != nil {
+                break
+            }
+            read++
+            lastClock = int(args[clockIdx].(*sql.NullInt64).Int64)
+            if !isTrends {
+                lastNs = int(args[nsIdx].(*sql.NullInt64).Int64)
+            }
+            row, ok := conv.Convert(args, itemid)
+            if !ok {
+                continue
+            }
+            err = w.Write(key, row)
+            if err != nil {
+                break
+            }
+            eCount++
+        }
+        if err == nil {
+            err = rows.Err()
+        }
+        rows.Close()
+        if err != nil {
+            return eCount, err
+        }
+        if isTrends || read < limitOffset {
+            break
+        }
+    }
+    return eCount, nil
+}
+
+// ExportItems writes the rows of the items inside of the window item by item.
+func (db *ZabbixDB) ExportItems(w HistoryWriter, table string, itemids []int, iMap ItemMap, window SyncWindow) (int, error) {
+    count := 0
+    for _, itemid := range itemids {
+        eCount, err := db.ExportItem(w, table, itemid, iMap[itemid], window)
+        count += eCount
+        if err != nil {
+            return count, fmt.Errorf("itemid [%d]: %s", itemid, err)
+        }
+    }
+    return count, nil
+}
+
+// ExportDays writes the rows of the items day by day in utc, all items of a
+// day before the next one, from the first to the last clock of the items.
+func (db *ZabbixDB) ExportDays(w DayWriter, table string, itemids []int, iMap ItemMap, window SyncWindow) (int, error) {
+    first, last, ok, err := db.ClockRange(table, itemids, window)
+    if err != nil || !ok {
+        return 0, err
+    }
+    beginClock, endClock := window.Bounds()
+    count := 0
+    for day := first - first%86400; day <= last; day += 86400 {
+        dayWindow := SyncWindow{From: day, To: day + 86400}
+        if dayWindow.From < beginClock {
+            dayWindow.From = beginClock
+        }
+        if dayWindow.To > endClock {
+            dayWindow.To = endClock
+        }
+        eCount, err := db.ExportItems(w, table, itemids, iMap, dayWindow)
+        count += eCount
+        if err != nil {
+            return count, err
+        }
+        err = w.EndDay()
+        if err != nil {
+            return count, err
+        }
+    }
+    return count, nil
+}
+
+// ClockRange returns the first and last clock of the items inside of the
+// window, ok is false without rows.
+func (db *ZabbixDB) ClockRange(table string, itemids []int, window SyncWindow) (int64, int64, bool, error) {
+    if len(itemids) == 0 {
+        return 0, 0, false, nil
+    }
+    beginClock, endClock := window.Bounds()
+    args := make([]interface{}, 0, len(itemids)+2)
+    for _, itemid := range itemids {
+        args = append(args, itemid)
+    }
+    args = append(args, beginClock, endClock)
+    var first, last sql.NullInt64
+    err := db.QueryRow(
+        fmt.Sprintf(
+            "select min(clock), max(clock) from %s where itemid in (%s) and clock >= ? and clock < ?",
+            table, strings.TrimSuffix(strings.Repeat("?, ", len(itemids)), ", "),
+        ),
+        args...,
+    ).Scan(&first, &last)
+    if err != nil {
+        return 0, 0, false, err
+    }
+    return first.Int64, last.Int64, first.Valid, nil
+}
+
+// ExportHistory writes the history and trends of the hosts inside of the
+// window by the writers of newWriter, only of the table when it is not empty.
+func ExportHistory(aZDB *ZabbixDB, hostgroup string, table string, hostIdBegin int, offset uint, window SyncWindow, newWriter NewHistoryWriter) error {
+    log.WithFields(log.Fields{
+        "func": "ExportHistory",
+        "step": "start",
+    }).Debug("start export old history")
+
+    hMapList, err := aZDB.GetHostMapList(hostgroup, hostIdBegin, offset)
+    if err != nil {
+        return err
+    }
+
+    tables := make([]string, 0)
+    for _, t := range append(append([]string{}, HistoryTables...), TrendsTables...) {
+        if table != "" && table != t {
+            continue
+        }
+        tables = append(tables, t)
+    }
+
+    for _, hMap := range hMapList {
+        for hostid, host := range hMap {
+            iMap, err := aZDB.GetItemMap(hostid)
+            if err != nil {
+                return err
+            }
+            itemids := make([]int, 0, len(iMap))
+            for itemid := range iMap {
+                itemids = append(itemids, itemid)
+            }
+            sort.Ints(itemids)
+
+            for _, t := range tables {
+                w, err := newWriter(t, hostid, host)
+                if err != nil {
+                    return err
+                }
+                if w == nil {
+                    continue
+                }
+                var hCount int
+                if dw, ok := w.(DayWriter); ok {
+                    hCount, err = aZDB.ExportDays(dw, t, itemids, iMap, window)
+                } else {
+                    hCount, err = aZDB.ExportItems(w, t, itemids, iMap, window)
+                }
+                if err != nil {
+                    w.Close()
+                    return fmt.Errorf("export %s host [%s]: %s", t, host, err)
+                }
+                err = w.Close()
+                if err != nil {
+                    return err
+                }
+                log.WithFields(log.Fields{
+                    "func": "ExportHistory",
+                    "step": "export",
+                }).Infof("done export %s host [%s] hostid [%d], %d rows in %d parts", t, host, hostid, hCount, w.Parts())
+            }
+        }
+    }
+
+    log.WithFields(log.Fields{
+        "func": "ExportHistory",
+        "step": "finish",
+    }).Debug("finish export old history")
+    return nil
+}
+
+// ExportReader reads the records of one file written by ExportWriter, the
+// table is the name of its directory.
+type ExportReader struct {
+    Path    string
+    Table   string
+    Format  string
+
+    file    *os.File
+    gz      *gzip.Reader
+    csv     *csv.Reader
+    json    *json.Decoder
+    header  []string
+}
+
+func OpenExportFile(path string) (*ExportReader, error) {
+    r := &ExportReader{
+        Path: path,
+        Table: filepath.Base(filepath.Dir(path)),
+    }
+    switch {
+    case strings.HasSuffix(path, "."+ExportFormatNDJSON+".gz"):
+        r.Format = ExportFormatNDJSON
+    case strings.HasSuffix(path, "."+ExportFormatCSV+".gz"):
+        r.Format = ExportFormatCSV
+    default:
+        return nil, fmt.Errorf("cannot support import for the file %s", path)
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    gz, err := gzip.NewReader(file)
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    r.file = file
+    r.gz = gz
+
+    if r.Format == ExportFormatCSV {
+        r.csv = csv.NewReader(gz)
+        r.header, err = r.csv.Read()
+        if err != nil {
+            r.Close()
+            return nil, err
+        }
+        return r, nil
+    }
+    r.json = json.NewDecoder(gz)
+    r.json.UseNumber()
+    return r, nil
+}
+
+// Next returns the next record by column, io.EOF at the end of the file.
+func (r *ExportReader) Next() (map[string]string, error) {
+    res := make(map[string]string)
+    if r.csv != nil {
+        record, err := r.csv.Read()
+        if err != nil {
+            return nil, err
+        }
+        for idx, name := range r.header {
+            if idx < len(record) {
+                res[name] = record[idx]
+            }
+        }
+        return res, nil
+    }
+
+    var record map[string]interface{}
+    err := r.json.Decode(&record)
+    if err != nil {
+        return nil, err
+    }
+    for name, v := range record {
+        switch v := v.(type) {
+        case nil:
+        case string:
+            res[name] = v
+        default:
+            res[name] = fmt.Sprint(v)
+        }
+    }
+    return res, nil
+}
+
+func (r *ExportReader) Close() error {
+    r.gz.Close()
+    return r.file.Close()
+}
+
+// SetArgs fills the holders of ScanArgs from the record of an export file as
+// if the row was read from the Source table, the itemid is left zero.
+func (c *RowConverter) SetArgs(args []interface{}, record map[string]string) error {
+    for idx, spec := range c.SourceSpecs {
+        if spec.Name == "itemid" {
+            continue
+        }
+        s, ok := record[spec.Name]
+        if !ok {
+            continue
+        }
+        switch spec.Kind {
+        case ColumnInt:
+            v, err := strconv.ParseInt(s, 10, 64)
+            if err != nil {
+                return fmt.Errorf("column %s: %s", spec.Name, err)
+            }
+            *args[idx].(*sql.NullInt64) = sql.NullInt64{Int64: v, Valid: true}
+        case ColumnFloat:
+            v, err := strconv.ParseFloat(s, 64)
+            if err != nil {
+                return fmt.Errorf("column %s: %s", spec.Name, err)
+            }
+            *args[idx].(*sql.NullFloat64) = sql.NullFloat64{Float64: v, Valid: true}
+        default:
+            *args[idx].(*sql.NullString) = sql.NullString{String: s, Valid: true}
+        }
+    }
+    return nil
+}
+
+// ImportFile loads one export file into this zabbix. The keys of the host are
+// mapped by MappingItemId, so the rename map and value_type routing of the
+// sync apply too. Only rows inside of the window are written. The file is
+// read twice, first for its keys and then for the rows to write. The rows of
+// all tables are written together, after each write the count of records
+// written is saved in the checkpoint under name, and a resume skips them.
+func (db *ZabbixDB) ImportFile(path string, window SyncWindow, cp *Checkpoint, name string) (int, error) {
+    r, err := OpenExportFile(path)
+    if err != nil {
+        return 0, err
+    }
+
+    // the keys get ids of the file to be mapped like the items of a host
+    host := ""
+    keyIds := make(map[string]int)
+    iMap := make(ItemMap)
+    for {
+        record, err := r.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            r.Close()
+            return 0, err
+        }
+        if host == "" {
+            host = record["host"]
+        }
+        key := record["key_"]
+        if _, ok := keyIds[key]; !ok {
+            keyIds[key] = len(keyIds) + 1
+            iMap[keyIds[key]] = key
+        }
+    }
+    r.Close()
+    if len(keyIds) == 0 {
+        return 0, nil
+    }
+
+    mapping, err := db.MappingItemId(host, iMap)
+    if err != nil {
+        return 0, err
+    }
+    for _, key := range mapping.Unmapped {
+        log.WithFields(log.Fields{
+            "func": "ZabbixDB.ImportFile",
+            "step": "mapping",
+        }).Errorf("not found itemid mapping for host [%s] key [%s] in %s", host, key, path)
+        delete(keyIds, key)
+    }
+
+    r, err = OpenExportFile(path)
+    if err != nil {
+        return 0, err
+    }
+    defer r.Close()
+
+    isTrends := strings.HasPrefix(r.Table, "trends")
+    beginClock, endClock := window.Bounds()
+    iCount := 0
+    skip, records := 0, 0
+    if cp != nil {
+        if entry, ok := cp.Host(name, window, 0); ok {
+            skip = entry.Clock
+        }
+    }
+    convs := make(map[string]*RowConverter)
+    pending := make(map[string][][]interface{})
+    flush := func(table string) error {
+        rows := pending[table]
+        if len(rows) == 0 || db.ValidateOnly {
+            pending[table] = rows[:0]
+            return nil
+        }
+        columns := convs[table].Columns()
+        prefix := fmt.Sprintf("insert into %s (%s) values ", table, strings.Join(columns, ", "))
+        suffix := ""
+        if isTrends {
+            suffix = db.TrendsUpsert()
+        }
+        err := db.InsertRows(prefix, suffix, len(columns), rows)
+        if err != nil {
+            return err
+        }
+        db.TimescaleProgress.Add(table, columns, rows)
+        iCount += len(rows)
+        pending[table] = rows[:0]
+        return nil
+    }
+    flushAll := func() error {
+        for table := range convs {
+            err := flush(table)
+            if err != nil {
+                return err
+            }
+        }
+        if cp == nil || db.ValidateOnly {
+            return nil
+        }
+        return cp.Save(NewCheckpointEntry(name, window, 0, 0, records, 0, false))
+    }
+
+    for {
+        record, err := r.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return iCount, err
+        }
+        records++
+        if records <= skip {
+            continue
+        }
+        itemid, ok := keyIds[record["key_"]]
+        if !ok {
+            continue
+        }
+        table := mapping.TargetTable(r.Table, itemid)
+        if table == "" {
+            continue
+        }
+        conv, ok := convs[table]
+        if !ok {
+            conv, err = db.NewTableConverter(r.Table, table)
+            if err != nil {
+                return iCount, err
+            }
+            convs[table] = conv
+        }
+        args := conv.ScanArgs()
+        err = conv.SetArgs(args, record)
+        if err != nil {
+            return iCount, fmt.Errorf("%s host [%s] key [%s]: %s", path, host, record["key_"], err)
+        }
+        clock := args[conv.Index("clock")].(*sql.NullInt64).Int64
+        if clock < beginClock || clock >= endClock {
+            continue
+        }
+        row, ok := conv.Convert(args, mapping.Itemids[itemid])
+        if !ok {
+            continue
+        }
+        pending[table] = append(pending[table], row)
+        if len(pending[table]) >= importFlushRows {
+            err = flushAll()
+            if err != nil {
+                return iCount, err
+            }
+        }
+    }
+    err = flushAll()
+    if err != nil {
+        return iCount, err
+    }
+    for table, conv := range convs {
+        if len(conv.Issues) > 0 {
+            log.WithFields(log.Fields{
+                "func": "ZabbixDB.ImportFile",
+                "step": "issues",
+            }).Warnf("%s values not fit for %s %s: %s", path, conv.Target, table, conv.IssueString())
+        }
+    }
+    return iCount, nil
+}
+
+// ImportHistory loads the export files under dir into the new zabbix, the
+// files already done in the checkpoint are skipped and the files in progress
+// go on after their records written.
+func ImportHistory(bZDB *ZabbixDB, dir string, window SyncWindow, cp *Checkpoint, ignoreErr bool) error {
+    log.WithFields(log.Fields{
+        "func": "ImportHistory",
+        "step": "start",
+    }).Debug("start import history files to new zabbix")
+
+    paths := make([]string, 0)
+    tables := make(map[string]bool)
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if info.IsDir() || !(strings.HasSuffix(path, "."+ExportFormatNDJSON+".gz") || strings.HasSuffix(path, "."+ExportFormatCSV+".gz")) {
+            return nil
+        }
+        paths = append(paths, path)
+        tables[filepath.Base(filepath.Dir(path))] = true
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    tableList := make([]string, 0, len(tables))
+    for _, table := range append(append([]string{}, HistoryTables...), TrendsTables...) {
+        if tables[table] {
+            tableList = append(tableList, table)
+        }
+    }
+    restore, err := PrepareTimescale(bZDB, tableList, window)
+    if err != nil {
+        return err
+    }
+    defer restore()
+
+    failed := 0
+    for idx, path := range paths {
+        name, _ := filepath.Rel(dir, path)
+        if cp != nil && cp.HostDone("import:"+name, window, 0) {
+            log.WithFields(log.Fields{
+                "func": "ImportHistory",
+                "step": "checkpoint",
+            }).Debugf("skip %s, already done in checkpoint", name)
+            continue
+        }
+        iCount, err := bZDB.ImportFile(path, window, cp, "import:"+name)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "ImportHistory",
+                "step": "import",
+            }).Errorf("[%d/%d] try to import %s is failed: %s", idx+1, len(paths), name, err)
+            if ignoreErr {
+                failed++
+                continue
+            }
+            return err
+        }
+        if cp != nil {
+            err = cp.SaveHost("import:"+name, window, 0)
+            if err != nil {
+                return err
+            }
+        }
+        log.WithFields(log.Fields{
+            "func": "ImportHistory",
+            "step": "import",
+        }).Infof("[%d/%d] done import %s, insert count is %d", idx+1, len(paths), name, iCount)
+    }
+    if failed > 0 {
+        return fmt.Errorf("%d of %d files failed to import", failed, len(paths))
+    }
+
+    log.WithFields(log.Fields{
+        "func": "ImportHistory",
+        "step": "finish",
+    }).Debug("finish import history files to new zabbix")
+    return nil
+}
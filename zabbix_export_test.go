@@ -0,0 +1,72 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestExportFiles(t *testing.T) {
+    dir, err := ioutil.TempDir("", "zabbix_export")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    for _, format := range []string{ExportFormatNDJSON, ExportFormatCSV} {
+        w, err := NewExportWriter(dir, "history_uint", format, 10084, "Zabbix server", 2)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i := 0; i < 3; i++ {
+            row := []interface{}{int64(100), int64(1600000000 + i), "18446744073709551615", int64(i)}
+            err = w.Write("vm.memory.size[total]", row)
+            if err != nil {
+                t.Fatal(err)
+            }
+        }
+        err = w.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(w.Files) != 2 || filepath.Base(w.Files[1]) != "10084_Zabbix_server.0001."+format+".gz" {
+            t.Fatalf("unexpected export files: %v", w.Files)
+        }
+
+        conv, _ := NewConverter("history_uint", "history_uint", "mysql", map[string]ColumnLimit{}, false)
+        count := 0
+        for _, path := range w.Files {
+            r, err := OpenExportFile(path)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if r.Table != "history_uint" {
+                t.Fatalf("unexpected table of export file: %s", r.Table)
+            }
+            for {
+                record, err := r.Next()
+                if err != nil {
+                    break
+                }
+                if record["host"] != "Zabbix server" || record["key_"] != "vm.memory.size[total]" {
+                    t.Fatalf("unexpected export record: %v", record)
+                }
+                args := conv.ScanArgs()
+                err = conv.SetArgs(args, record)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                row, ok := conv.Convert(args, 200)
+                if !ok || row[0] != int64(200) || row[1] != int64(1600000000+count) || row[2] != "18446744073709551615" || row[3] != int64(count) {
+                    t.Fatalf("unexpected imported row: %v", row)
+                }
+                count++
+            }
+            r.Close()
+        }
+        if count != 3 {
+            t.Fatalf("expect 3 rows in %s files, got %d", format, count)
+        }
+    }
+}
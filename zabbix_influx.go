@@ -0,0 +1,195 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const DefaultInfluxBatch = 5000
+
+var (
+    influxNameEscaper   = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+    influxTagEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+    influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// InfluxClient posts line protocol to the write endpoint of influxdb, like
+// http://influx:8086/write?db=zabbix&precision=ns for 1.x or
+// http://influx:8086/api/v2/write?org=ops&bucket=zabbix&precision=ns for 2.x,
+// the 1.x endpoint takes the token of 2.x as the password p.
+type InfluxClient struct {
+    URL     string
+    Client  *http.Client
+    Retries int
+}
+
+func NewInfluxClient(url string) *InfluxClient {
+    return &InfluxClient{
+        URL: url,
+        Client: &http.Client{
+            Timeout: 30 * time.Second,
+        },
+        Retries: 3,
+    }
+}
+
+func (c *InfluxClient) Send(body []byte) error {
+    return postRetry(c.Client, c.URL, c.Retries, body, map[string]string{
+        "Content-Type": "text/plain; charset=utf-8",
+    })
+}
+
+// InfluxLine formats one point of the item key, the columns of the table after
+// the itemid and clock are the fields and the timestamp is in nanoseconds.
+// Uint values are written as integers, influxdb 1.x has no unsigned fields, so
+// it is false for a value over the int64 range.
+func InfluxLine(key string, tags []PromLabel, specs []ColumnSpec, row []interface{}) ([]byte, bool) {
+    var buf bytes.Buffer
+    buf.WriteString(influxNameEscaper.Replace(key))
+    for _, tag := range tags {
+        if tag.Value == "" {
+            continue
+        }
+        buf.WriteByte(',')
+        buf.WriteString(influxTagEscaper.Replace(tag.Name))
+        buf.WriteByte('=')
+        buf.WriteString(influxTagEscaper.Replace(tag.Value))
+    }
+
+    ts := row[1].(int64) * int64(time.Second)
+    sep := byte(' ')
+    for idx, spec := range specs[2:] {
+        v := row[idx+2]
+        if spec.Name == "ns" {
+            ts += v.(int64)
+            continue
+        }
+        buf.WriteByte(sep)
+        sep = ','
+        buf.WriteString(influxTagEscaper.Replace(spec.Name))
+        buf.WriteByte('=')
+        switch spec.Kind {
+        case ColumnInt:
+            buf.WriteString(strconv.FormatInt(v.(int64), 10))
+            buf.WriteByte('i')
+        case ColumnUint:
+            if _, err := strconv.ParseInt(v.(string), 10, 64); err != nil {
+                return nil, false
+            }
+            buf.WriteString(v.(string))
+            buf.WriteByte('i')
+        case ColumnFloat:
+            buf.WriteString(strconv.FormatFloat(v.(float64), 'g', -1, 64))
+        default:
+            buf.WriteByte('"')
+            buf.WriteString(influxStringEscaper.Replace(v.(string)))
+            buf.WriteByte('"')
+        }
+    }
+    buf.WriteByte(' ')
+    buf.WriteString(strconv.FormatInt(ts, 10))
+    buf.WriteByte('\n')
+    return buf.Bytes(), true
+}
+
+// InfluxExportWriter writes the history or trends of one host as line
+// protocol with the item key as measurement and the host and host groups as
+// tags, posted every Batch lines by the Client or into gzip files of the Out.
+type InfluxExportWriter struct {
+    Client  *InfluxClient
+    Out     *ExportWriter
+    Specs   []ColumnSpec
+    Tags    []PromLabel
+    Batch   int
+
+    buf         bytes.Buffer
+    lines       int
+    skipped     int
+    requests    int
+}
+
+func NewInfluxExportWriter(aZDB *ZabbixDB, client *InfluxClient, dir string, table string, hostid int, host string, chunkRows int, batch int) (*InfluxExportWriter, error) {
+    specs, ok := TableSpecs[table]
+    if !ok {
+        return nil, fmt.Errorf("cannot support export for the table %s", table)
+    }
+    groups, err := aZDB.GetHostGroupNames(hostid)
+    if err != nil {
+        return nil, err
+    }
+    if batch <= 0 {
+        batch = DefaultInfluxBatch
+    }
+    w := &InfluxExportWriter{
+        Client: client,
+        Specs: specs,
+        Tags: []PromLabel{
+            {"host", host},
+            {"hostgroup", strings.Join(groups, ",")},
+        },
+        Batch: batch,
+    }
+    if client == nil {
+        w.Out, err = NewExportWriter(dir, table, ExportFormatInflux, hostid, host, chunkRows)
+    }
+    return w, err
+}
+
+// Write adds the row converted from the table, its first column is the itemid.
+// The rows with a uint over the int64 range are skipped.
+func (w *InfluxExportWriter) Write(key string, row []interface{}) error {
+    line, ok := InfluxLine(key, w.Tags, w.Specs, row)
+    if !ok {
+        w.skipped++
+        return nil
+    }
+    if w.Out != nil {
+        return w.Out.WriteLine(line)
+    }
+    w.buf.Write(line)
+    w.lines++
+    if w.lines >= w.Batch {
+        return w.flush()
+    }
+    return nil
+}
+
+func (w *InfluxExportWriter) flush() error {
+    if w.lines == 0 {
+        return nil
+    }
+    err := w.Client.Send(w.buf.Bytes())
+    if err != nil {
+        return err
+    }
+    w.requests++
+    w.buf.Reset()
+    w.lines = 0
+    return nil
+}
+
+func (w *InfluxExportWriter) Parts() int {
+    if w.Out != nil {
+        return w.Out.Parts()
+    }
+    return w.requests
+}
+
+func (w *InfluxExportWriter) Close() error {
+    if w.skipped > 0 {
+        log.WithFields(log.Fields{
+            "func": "InfluxExportWriter.Close",
+            "step": "skipped",
+        }).Warnf("skip %d points of host [%s] with uint values over the int64 range of influxdb", w.skipped, w.Tags[0].Value)
+    }
+    if w.Out != nil {
+        return w.Out.Close()
+    }
+    return w.flush()
+}
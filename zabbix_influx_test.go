@@ -0,0 +1,59 @@
+package main
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestInfluxExport(t *testing.T) {
+    tags := []PromLabel{{"host", "web 01"}, {"hostgroup", "Linux servers,Web"}}
+    lines := []struct {
+        table string
+        row   []interface{}
+        want  string
+    }{
+        {"history_uint", []interface{}{int64(1), int64(100), "9223372036854775807", int64(5)},
+            `system.cpu.util[\,user],host=web\ 01,hostgroup=Linux\ servers\,Web value=9223372036854775807i 100000000005` + "\n"},
+        {"history_str", []interface{}{int64(1), int64(100), `say "hi"`, int64(0)},
+            `system.cpu.util[\,user],host=web\ 01,hostgroup=Linux\ servers\,Web value="say \"hi\"" 100000000000` + "\n"},
+        {"trends", []interface{}{int64(1), int64(3600), int64(60), 0.5, 1.25, 2.0},
+            `system.cpu.util[\,user],host=web\ 01,hostgroup=Linux\ servers\,Web num=60i,value_min=0.5,value_avg=1.25,value_max=2 3600000000000` + "\n"},
+    }
+    for _, l := range lines {
+        line, ok := InfluxLine("system.cpu.util[,user]", tags, TableSpecs[l.table], l.row)
+        if got := string(line); !ok || got != l.want {
+            t.Errorf("%s line = %q, want %q", l.table, got, l.want)
+        }
+    }
+    if _, ok := InfluxLine("vm.memory", tags, TableSpecs["history_uint"], []interface{}{int64(1), int64(100), "18446744073709551615", int64(0)}); ok {
+        t.Error("uint over the int64 range is written")
+    }
+
+    var bodies []string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        buf, _ := ioutil.ReadAll(r.Body)
+        bodies = append(bodies, string(buf))
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    defer srv.Close()
+
+    w := &InfluxExportWriter{
+        Client: NewInfluxClient(srv.URL),
+        Specs: TableSpecs["history"],
+        Tags: []PromLabel{{"host", "web-01"}},
+        Batch: 2,
+    }
+    for i := int64(0); i < 3; i++ {
+        if err := w.Write("load", []interface{}{int64(1), 100 + i, 0.5, int64(0)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if w.Parts() != 2 || len(bodies) != 2 || bodies[1] != "load,host=web-01 value=0.5 102000000000\n" {
+        t.Errorf("requests = %d, bodies = %q", w.Parts(), bodies)
+    }
+}
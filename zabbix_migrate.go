@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "encoding/json"
     "errors"
     "fmt"
@@ -87,7 +88,18 @@ func DiffUnitList(aUnitList, bUnitList []ZUnitMap, hasEcho bool) (bool, error) {
     return isSame, nil
 }
 
-func CreateNewHostGroup(aZAPI, bZAPI *ZabbixAPI) error {
+// sleepContext waits for d, it returns the error of the ctx when it is done
+// before.
+func sleepContext(ctx context.Context, d time.Duration) error {
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-time.After(d):
+        return nil
+    }
+}
+
+func CreateNewHostGroup(ctx context.Context, aZAPI, bZAPI *ZabbixAPI) error {
     log.WithFields(log.Fields{
         "func": "CreateNewHostGroup",
         "step": "start",
@@ -97,7 +109,7 @@ func CreateNewHostGroup(aZAPI, bZAPI *ZabbixAPI) error {
     aFilter := make(map[string]interface{}, 0)
     aParams["output"] = "extend"
     aParams["filter"] = aFilter
-    aZHostGroupList, err := aZAPI.HostGroup("get", aParams)
+    aZHostGroupList, err := aZAPI.HostGroup(ctx, "get", aParams)
     if err != nil {
         return err
     }
@@ -106,7 +118,7 @@ func CreateNewHostGroup(aZAPI, bZAPI *ZabbixAPI) error {
     bFilter := make(map[string]interface{}, 0)
     bParams["output"] = "extend"
     bParams["filter"] = bFilter
-    bZHostGroupList, err := bZAPI.HostGroup("get", bParams)
+    bZHostGroupList, err := bZAPI.HostGroup(ctx, "get", bParams)
     if err != nil {
         return err
     }
@@ -128,7 +140,7 @@ func CreateNewHostGroup(aZAPI, bZAPI *ZabbixAPI) error {
             continue
         }
         tParams["name"] = aZHostGroup["name"]
-        _, err := bZAPI.HostGroup("create", tParams)
+        _, err := bZAPI.HostGroup(ctx, "create", tParams)
         if err != nil {
             return err
         }
@@ -141,15 +153,23 @@ func CreateNewHostGroup(aZAPI, bZAPI *ZabbixAPI) error {
     return nil
 }
 
-func CreateNewValuemap(aZAPI ,bZAPI *ZabbixAPI) error {
+func CreateNewValuemap(ctx context.Context, aZAPI ,bZAPI *ZabbixAPI) error {
     log.WithFields(log.Fields{
         "func": "CreateNewValuemap",
         "step": "start",
     }).Debug("start create new valuemap on new zabbix")
 
+    if !aZAPI.Caps().GlobalValuemaps || !bZAPI.Caps().GlobalValuemaps {
+        log.WithFields(log.Fields{
+            "func": "CreateNewValuemap",
+            "step": "version",
+        }).Infof("skip valuemaps, since zabbix 5.4 they belong to templates and hosts and come with them (old %s, new %s)", aZAPI.Version, bZAPI.Version)
+        return nil
+    }
+
     aParams := make(map[string]interface{}, 0)
     aParams["output"] = "extend"
-    aZValuemapList, err := aZAPI.Valuemap("get", aParams)
+    aZValuemapList, err := aZAPI.Valuemap(ctx, "get", aParams)
     if err != nil {
         return err
     }
@@ -176,7 +196,7 @@ func CreateNewValuemap(aZAPI ,bZAPI *ZabbixAPI) error {
         aOptions["valueMaps"] = tValuemapList
         aParams["options"] = aOptions
         aParams["format"] = "xml"
-        aTemplateExport, err := aZAPI.Configuration("export", aParams)
+        aTemplateExport, err := aZAPI.Configuration(ctx, "export", aParams)
         if err != nil {
             log.WithFields(log.Fields{
                 "func": "CreateNewValuemap",
@@ -251,10 +271,10 @@ func CreateNewValuemap(aZAPI ,bZAPI *ZabbixAPI) error {
             "updateExisting": false,
             "createMissing": true,
         }
-        bParams["rules"] = bRules
+        bParams["rules"] = bZAPI.Caps().ImportRules(bRules)
         bParams["format"] = "xml"
         bParams["source"] = aTemplateExport
-        res, err := bZAPI.Configuration("import", bParams)
+        res, err := bZAPI.Configuration(ctx, "import", bParams)
         if err != nil {
             log.WithFields(log.Fields{
                 "func": "CreateNewValuemap",
@@ -269,7 +289,10 @@ func CreateNewValuemap(aZAPI ,bZAPI *ZabbixAPI) error {
             }).Errorf("try to import first valuemap [%s] is failed", tValuemapList[0])
             return errors.New("result of import valuemap task is false")
         }
-        time.Sleep(2*time.Second)
+        err = sleepContext(ctx, 2*time.Second)
+        if err != nil {
+            return err
+        }
     }
 
     log.WithFields(log.Fields{
@@ -279,14 +302,14 @@ func CreateNewValuemap(aZAPI ,bZAPI *ZabbixAPI) error {
     return nil
 }
 
-func SortTemplateDepend(aZAPI *ZabbixAPI) ([]int, error) {
+func SortTemplateDepend(ctx context.Context, aZAPI *ZabbixAPI) ([]int, error) {
     aParams := make(map[string]interface{}, 0)
     aFilter := make(map[string]interface{}, 0)
     aParams["output"] = "templateid"
     aParams["filter"] = aFilter
     aParams["selectParentTemplates"] = []string{"templateid"}
     // aParams["selectDiscoveries"] = []string{"templateid"}
-    aZMulTemplateList, err := aZAPI.Template("get", aParams)
+    aZMulTemplateList, err := aZAPI.Template(ctx, "get", aParams)
     if err != nil {
         return []int{}, err
     }
@@ -341,7 +364,7 @@ func SortTemplateDepend(aZAPI *ZabbixAPI) ([]int, error) {
     aParams["output"] = "extend"
     aParams["filter"] = aFilter
     aParams["selectTemplates"] = []string{"templateid"}
-    aZMulHPrototypeList, err := aZAPI.Hostprototype("get", aParams)
+    aZMulHPrototypeList, err := aZAPI.Hostprototype(ctx, "get", aParams)
     if err != nil {
         return []int{}, err
     }
@@ -450,7 +473,7 @@ func itemFind(slice []string, val string) bool {
     return false
 }
 
-func CleanNewTemplate(bZAPI *ZabbixAPI, bZDB *ZabbixDB) error {
+func CleanNewTemplate(ctx context.Context, bZAPI *ZabbixAPI, bZDB *ZabbixDB) error {
     log.WithFields(log.Fields{
         "func": "CleanNewTemplate",
         "step": "start",
@@ -474,14 +497,17 @@ func CleanNewTemplate(bZAPI *ZabbixAPI, bZDB *ZabbixDB) error {
             tTemplateList = bTemplateList[step*i:step*(i+1)]
         }
         bParams := tTemplateList
-        _, err := bZAPI.Template("delete", bParams)
+        _, err := bZAPI.Template(ctx, "delete", bParams)
         if err != nil {
             if len(tTemplateList) > 0 {
                 log.Errorf("try to delete first template [%d] is failed", tTemplateList[0])
             }
             return err
         }
-        time.Sleep(2*time.Second)
+        err = sleepContext(ctx, 2*time.Second)
+        if err != nil {
+            return err
+        }
     }
 
     log.WithFields(log.Fields{
@@ -491,14 +517,14 @@ func CleanNewTemplate(bZAPI *ZabbixAPI, bZDB *ZabbixDB) error {
     return nil
 }
 
-func CreateNewTemplate(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI) error {
+func CreateNewTemplate(ctx context.Context, aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI) error {
     log.WithFields(log.Fields{
         "func": "CreateNewTemplate",
         "step": "start",
     }).Debug("start create new template on new zabbix")
 
     // aTemplateList, err := aZDB.GetTemplateList()
-    aTemplateList, err := SortTemplateDepend(aZAPI)
+    aTemplateList, err := SortTemplateDepend(ctx, aZAPI)
     if err != nil {
         return err
     }
@@ -520,7 +546,7 @@ func CreateNewTemplate(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI) error
         aOptions["templates"] = tTemplateList
         aParams["options"] = aOptions
         aParams["format"] = "xml"
-        aTemplateExport, err := aZAPI.Configuration("export", aParams)
+        aTemplateExport, err := aZAPI.Configuration(ctx, "export", aParams)
         if err != nil {
             if len(tTemplateList) > 0 {
                 log.WithFields(log.Fields{
@@ -602,10 +628,10 @@ func CreateNewTemplate(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI) error
             "updateExisting": false,
             "createMissing": true,
         }
-        bParams["rules"] = bRules
+        bParams["rules"] = bZAPI.Caps().ImportRules(bRules)
         bParams["format"] = "xml"
         bParams["source"] = aTemplateExport
-        res, err := bZAPI.Configuration("import", bParams)
+        res, err := bZAPI.Configuration(ctx, "import", bParams)
         if err != nil {
             if len(tTemplateList) > 1 {
                 log.WithFields(log.Fields{
@@ -630,7 +656,10 @@ func CreateNewTemplate(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI) error
             "step": "import",
         }).Infof("done import %d templates for import", len(tTemplateList))
 
-        time.Sleep(2*time.Second)
+        err = sleepContext(ctx, 2*time.Second)
+        if err != nil {
+            return err
+        }
     }
 
     log.WithFields(log.Fields{
@@ -640,7 +669,7 @@ func CreateNewTemplate(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI) error
     return nil
 }
 
-func CreateNewHost(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI, hostgroup string, hostIdBegin int, offset uint, ignoreErr bool) error {
+func CreateNewHost(ctx context.Context, aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI, hostgroup string, hostIdBegin int, offset uint, ignoreErr bool) error {
     log.WithFields(log.Fields{
         "func": "CreateNewHost",
         "step": "start",
@@ -676,7 +705,7 @@ func CreateNewHost(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI, hostgroup
         aOptions["hosts"] = tHostList
         aParams["options"] = aOptions
         aParams["format"] = "xml"
-        aHostExport, err := aZAPI.Configuration("export", aParams)
+        aHostExport, err := aZAPI.Configuration(ctx, "export", aParams)
         if err != nil {
             if len(tHostList) > 0 {
                 log.WithFields(log.Fields{
@@ -772,10 +801,10 @@ func CreateNewHost(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI, hostgroup
             "updateExisting": false,
             "createMissing": true,
         }
-        bParams["rules"] = bRules
+        bParams["rules"] = bZAPI.Caps().ImportRules(bRules)
         bParams["format"] = "xml"
         bParams["source"] = aHostExport
-        res, err := bZAPI.Configuration("import", bParams)
+        res, err := bZAPI.Configuration(ctx, "import", bParams)
         if err != nil {
             log.WithFields(log.Fields{
                 "func": "CreateNewHost",
@@ -828,7 +857,10 @@ func CreateNewHost(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI, hostgroup
                 return errors.New(fmt.Sprintf("%v", res))
             }
         }
-        time.Sleep(2*time.Second)
+        err = sleepContext(ctx, 2*time.Second)
+        if err != nil {
+            return err
+        }
     }
 
     log.WithFields(log.Fields{
@@ -838,7 +870,7 @@ func CreateNewHost(aZAPI *ZabbixAPI, aZDB *ZabbixDB, bZAPI *ZabbixAPI, hostgroup
     return nil
 }
 
-func SyncHistory(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, hTableInput string, hostIdBegin int, idOffset uint, dayOffset uint, ignoreErr bool) error {
+func SyncHistory(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, hTableInput string, hostIdBegin int, idOffset uint, window SyncWindow, workers uint, unit string, ignoreErr bool) error {
     log.WithFields(log.Fields{
         "func": "SyncHistory",
         "step": "start",
@@ -848,22 +880,34 @@ func SyncHistory(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, hTableInput s
     if err != nil {
         return err
     }
-    for _, hMap := range hMapList {
-        for _, hTable := range HistoryTables {
-            if hTableInput != "" && hTableInput != hTable {
-                continue
-            }
-            for hostid, host := range hMap {
-                err := aZDB.SyncHistoryToOne(bZDB, hTable, hostid, host, dayOffset, ignoreErr)
-                if err != nil {
-                    return err
-                }
-                log.WithFields(log.Fields{
-                    "func": "SyncHistory",
-                    "step": "sync.done",
-                }).Debugf("done sync history table [%s]: host [%s] hostid [%d]", hTable, host, hostid)
-            }
+
+    hTables := make([]string, 0)
+    for _, hTable := range HistoryTables {
+        if hTableInput != "" && hTableInput != hTable {
+            continue
         }
+        hTables = append(hTables, hTable)
+    }
+
+    tasks, err := BuildSyncTasks(aZDB, bZDB, SyncKindHistory, hTables, hMapList, unit)
+    if err != nil {
+        return err
+    }
+    log.WithFields(log.Fields{
+        "func": "SyncHistory",
+        "step": "dispatch",
+    }).Infof("dispatch %d sync tasks by %s to %d workers in window [%s]", len(tasks), unit, workers, window)
+
+    restore, err := PrepareTimescale(bZDB, hTables, window)
+    if err != nil {
+        return err
+    }
+    defer restore()
+
+    pool := NewSyncWorkerPool(aZDB, bZDB, workers, window, ignoreErr)
+    err = pool.Run(tasks, hTables)
+    if err != nil {
+        return err
     }
 
     log.WithFields(log.Fields{
@@ -873,7 +917,7 @@ func SyncHistory(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, hTableInput s
     return nil
 }
 
-func SyncTrends(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, hostIdBegin int, offset uint, ignoreErr bool) error {
+func SyncTrends(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, hostIdBegin int, offset uint, window SyncWindow, workers uint, unit string, ignoreErr bool) error {
     log.WithFields(log.Fields{
         "func": "SyncTrends",
         "step": "start",
@@ -883,34 +927,176 @@ func SyncTrends(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, hostIdBegin in
     if err != nil {
         return err
     }
+
+    tasks, err := BuildSyncTasks(aZDB, bZDB, SyncKindTrends, TrendsTables, hMapList, unit)
+    if err != nil {
+        return err
+    }
+    log.WithFields(log.Fields{
+        "func": "SyncTrends",
+        "step": "dispatch",
+    }).Infof("dispatch %d sync tasks by %s to %d workers in window [%s]", len(tasks), unit, workers, window)
+
+    restore, err := PrepareTimescale(bZDB, TrendsTables, window)
+    if err != nil {
+        return err
+    }
+    defer restore()
+
+    pool := NewSyncWorkerPool(aZDB, bZDB, workers, window, ignoreErr)
+    err = pool.Run(tasks, TrendsTables)
+    if err != nil {
+        return err
+    }
+
+    log.WithFields(log.Fields{
+        "func": "SyncTrends",
+        "step": "finish",
+    }).Debug("finish sync old trends to new zabbix")
+    return nil
+}
+
+// MissingDiscovered returns the discovered items of the old hosts without a
+// counterpart by host and key_ on the new zabbix, keyed by host name.
+func MissingDiscovered(aZDB *ZabbixDB, bZDB *ZabbixDB, hMapList []HostMap) (map[string]ItemMap, error) {
+    res := make(map[string]ItemMap)
     for _, hMap := range hMapList {
-        for _, sTable := range TrendsTables {
-            for hostid, host := range hMap {
-                err := aZDB.SyncTrendsToOne(bZDB, sTable, hostid, host, ignoreErr)
-                if err != nil {
-                    return err
-                }
-                log.WithFields(log.Fields{
-                    "func": "SyncTrends",
-                    "step": "sync.done",
-                }).Debugf("done sync trends table [%s]: host [%s] hostid [%d]", sTable, host, hostid)
+        for hostid, host := range hMap {
+            iMap, err := aZDB.GetDiscoveredItemMap(hostid)
+            if err != nil {
+                return nil, err
+            }
+            if len(iMap) == 0 {
+                continue
+            }
+            mapping, err := bZDB.MappingItemId(host, iMap)
+            if err != nil {
+                return nil, err
+            }
+            if len(mapping.Unmapped) > 0 {
+                res[host] = mapping.Unmapped
             }
         }
     }
+    return res, nil
+}
 
+// CreateNewDiscovered forces the discovery rules of the hosts on the new
+// zabbix to run, then waits until the discovered items of the old hosts
+// exist there too, so that their history and trends can be mapped by key_.
+// What is still missing after wait is printed as the report.
+func CreateNewDiscovered(ctx context.Context, aZDB *ZabbixDB, bZAPI *ZabbixAPI, bZDB *ZabbixDB, hostgroup string, hostIdBegin int, offset uint, wait time.Duration) error {
     log.WithFields(log.Fields{
-        "func": "SyncTrends",
+        "func": "CreateNewDiscovered",
+        "step": "start",
+    }).Debug("start discovery on new zabbix")
+
+    hMapList, err := aZDB.GetHostMapList(hostgroup, hostIdBegin, offset)
+    if err != nil {
+        return err
+    }
+
+    missing, err := MissingDiscovered(aZDB, bZDB, hMapList)
+    if err != nil {
+        return err
+    }
+    for host := range missing {
+        ruleList, err := bZDB.GetDiscoveryRuleList(bZDB.Rename.Host(host))
+        if err != nil {
+            return err
+        }
+        err = bZAPI.CheckNow(ctx, ruleList)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "CreateNewDiscovered",
+                "step": "check.now",
+            }).Errorf("try to execute %d discovery rules of host [%s] is failed: %s", len(ruleList), host, err)
+            continue
+        }
+        log.WithFields(log.Fields{
+            "func": "CreateNewDiscovered",
+            "step": "check.now",
+        }).Infof("done request %d discovery rules of host [%s]", len(ruleList), host)
+    }
+
+    deadline := time.Now().Add(wait)
+    for len(missing) > 0 && time.Now().Before(deadline) {
+        // on cancel the items still missing are reported
+        if sleepContext(ctx, 30*time.Second) != nil {
+            break
+        }
+        missing, err = MissingDiscovered(aZDB, bZDB, hMapList)
+        if err != nil {
+            return err
+        }
+        log.WithFields(log.Fields{
+            "func": "CreateNewDiscovered",
+            "step": "wait",
+        }).Infof("wait for discovery, %d hosts still miss discovered items", len(missing))
+    }
+
+    fmt.Println("===[start: discovered items without counterpart]")
+    for host, iMap := range missing {
+        for itemid, key_ := range iMap {
+            fmt.Printf("- host [%s] itemid [%d] key [%s]\n", host, itemid, key_)
+        }
+    }
+    fmt.Println("===[end:   discovered items without counterpart]")
+
+    log.WithFields(log.Fields{
+        "func": "CreateNewDiscovered",
         "step": "finish",
-    }).Debug("finish sync old trends to new zabbix")
+    }).Debug("finish discovery on new zabbix")
     return nil
 }
 
-func CheckHostGroup(aZAPI, bZAPI *ZabbixAPI) (bool, error) {
+// SyncFollow runs the sync pass again and again with a sleep of interval
+// between, until stopCh is closed. Then one last pass copies what came in
+// meanwhile, so the new zabbix has no gap at cutover. A failed pass is logged
+// and the next one tries again, only the last pass returns its error. The
+// checkpoint is compacted before every pass.
+func SyncFollow(interval time.Duration, stopCh <-chan struct{}, cp *Checkpoint, pass func() error) error {
+    compactPass := func() error {
+        if cp != nil {
+            err := cp.Compact()
+            if err != nil {
+                return err
+            }
+        }
+        return pass()
+    }
+    for n := 1; ; n++ {
+        log.WithFields(log.Fields{
+            "func": "SyncFollow",
+            "step": "pass.start",
+        }).Infof("start follow sync pass %d", n)
+
+        err := compactPass()
+        if err != nil {
+            log.WithFields(log.Fields{
+                "func": "SyncFollow",
+                "step": "pass.failed",
+            }).Errorf("follow sync pass %d is failed, try again in %s: %s", n, interval, err)
+        }
+
+        select {
+        case <-stopCh:
+            log.WithFields(log.Fields{
+                "func": "SyncFollow",
+                "step": "cutover",
+            }).Info("got cutover signal, start the last follow sync pass")
+            return compactPass()
+        case <-time.After(interval):
+        }
+    }
+}
+
+func CheckHostGroup(ctx context.Context, aZAPI, bZAPI *ZabbixAPI) (bool, error) {
     aParams := make(map[string]interface{}, 0)
     aFilter := make(map[string]interface{}, 0)
     aParams["output"] = "extend"
     aParams["filter"] = aFilter
-    aZHostGroupList, err := aZAPI.HostGroup("get", aParams)
+    aZHostGroupList, err := aZAPI.HostGroup(ctx, "get", aParams)
     if err != nil {
         return false, err
     }
@@ -919,12 +1105,20 @@ func CheckHostGroup(aZAPI, bZAPI *ZabbixAPI) (bool, error) {
     bFilter := make(map[string]interface{}, 0)
     bParams["output"] = "extend"
     bParams["filter"] = bFilter
-    bZHostGroupList, err := bZAPI.HostGroup("get", bParams)
+    bZHostGroupList, err := bZAPI.HostGroup(ctx, "get", bParams)
     if err != nil {
         return false, err
     }
+    // groups of templates are host groups before zabbix 6.2
+    if bZAPI.Caps().TemplateGroups && !aZAPI.Caps().TemplateGroups {
+        bZTemplateGroupList, err := bZAPI.TemplateGroup(ctx, "get", bParams)
+        if err != nil {
+            return false, err
+        }
+        bZHostGroupList = append(bZHostGroupList, bZTemplateGroupList...)
+    }
 
-    mFilter := []string {"groupid", "internal"}
+    mFilter := []string {"groupid", "internal", "flags", "uuid"}
     FilterZUM(aZHostGroupList, mFilter)
     FilterZUM(bZHostGroupList, mFilter)
     isSame, err := DiffUnitList(aZHostGroupList, bZHostGroupList, true)
@@ -935,7 +1129,7 @@ func CheckHostGroup(aZAPI, bZAPI *ZabbixAPI) (bool, error) {
     return isSame, nil
 }
 
-func CheckHost(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
+func CheckHost(ctx context.Context, aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     aParams := make(map[string]interface{}, 0)
     aFilter := make(map[string]interface{}, 0)
     if hostgroup != "" {
@@ -944,7 +1138,7 @@ func CheckHost(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     aParams["output"] = []string{"hosts"}
     aParams["selectHosts"] = []string{"name"}
     aParams["filter"] = aFilter
-    aZGroupHostList, err := aZAPI.HostGroup("get", aParams)
+    aZGroupHostList, err := aZAPI.HostGroup(ctx, "get", aParams)
     if err != nil {
         return false, err
     }
@@ -957,7 +1151,7 @@ func CheckHost(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     bParams["output"] = []string{"hosts"}
     bParams["selectHosts"] = []string{"name"}
     bParams["filter"] = bFilter
-    bZGroupHostList, err := bZAPI.HostGroup("get", bParams)
+    bZGroupHostList, err := bZAPI.HostGroup(ctx, "get", bParams)
     if err != nil {
         return false, err
     }
@@ -987,12 +1181,12 @@ func CheckHost(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     return isSame, nil
 }
 
-func CheckItem(aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
+func CheckItem(ctx context.Context, aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
     aParams := make(map[string]interface{}, 0)
     aParams["output"] = "key_"
     aParams["host"] = host
     aParams["sortfield"] = "key_"
-    aZItemList, err := aZAPI.Item("get", aParams)
+    aZItemList, err := aZAPI.Item(ctx, "get", aParams)
     if err != nil {
         return false, err
     }
@@ -1001,7 +1195,7 @@ func CheckItem(aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
     bParams["output"] = "key_"
     bParams["host"] = host
     bParams["sortfield"] = "key_"
-    bZItemList, err := bZAPI.Item("get", bParams)
+    bZItemList, err := bZAPI.Item(ctx, "get", bParams)
     if err != nil {
         return false, err
     }
@@ -1017,11 +1211,11 @@ func CheckItem(aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
     return isSame, nil
 }
 
-func CheckItemGroup(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
+func CheckItemGroup(ctx context.Context, aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     aParams := make(map[string]interface{}, 0)
     aParams["output"] = []string{"host"}
-    aParams["selectGroups"] = hostgroup
-    aZHostList, err := aZAPI.Host("get", aParams)
+    aParams[aZAPI.Caps().SelectHostGroups] = hostgroup
+    aZHostList, err := aZAPI.Host(ctx, "get", aParams)
     if err != nil {
         return false, err
     }
@@ -1043,7 +1237,7 @@ func CheckItemGroup(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     for _, host := range aHostList {
         var innerIsSame bool
         fmt.Printf("check for host [%s] ...\n", host)
-        innerIsSame, err = CheckItem(aZAPI, bZAPI, host)
+        innerIsSame, err = CheckItem(ctx, aZAPI, bZAPI, host)
         if err != nil {
             return false, err
         }
@@ -1055,12 +1249,12 @@ func CheckItemGroup(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     return isSame, nil
 }
 
-func CheckTriggerNum(aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
+func CheckTriggerNum(ctx context.Context, aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
     aParams := make(map[string]interface{}, 0)
     aParams["output"] = "triggerid"
     aParams["host"] = host
     aParams["sortfield"] = "triggerid"
-    aZTriggerList, err := aZAPI.Trigger("get", aParams)
+    aZTriggerList, err := aZAPI.Trigger(ctx, "get", aParams)
     if err != nil {
         return false, err
     }
@@ -1069,7 +1263,7 @@ func CheckTriggerNum(aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
     bParams["output"] = "triggerid"
     bParams["host"] = host
     bParams["sortfield"] = "triggerid"
-    bZTriggerList, err := bZAPI.Trigger("get", bParams)
+    bZTriggerList, err := bZAPI.Trigger(ctx, "get", bParams)
     if err != nil {
         return false, err
     }
@@ -1077,11 +1271,11 @@ func CheckTriggerNum(aZAPI, bZAPI *ZabbixAPI, host string) (bool, error) {
     return len(aZTriggerList) == len(bZTriggerList), nil
 }
 
-func CheckTriggerNumGroup(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
+func CheckTriggerNumGroup(ctx context.Context, aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, error) {
     aParams := make(map[string]interface{}, 0)
     aParams["output"] = []string{"host"}
-    aParams["selectGroups"] = hostgroup
-    aZHostList, err := aZAPI.Host("get", aParams)
+    aParams[aZAPI.Caps().SelectHostGroups] = hostgroup
+    aZHostList, err := aZAPI.Host(ctx, "get", aParams)
     if err != nil {
         return false, err
     }
@@ -1102,7 +1296,7 @@ func CheckTriggerNumGroup(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, erro
     isSame := true
     for _, host := range aHostList {
         var innerIsSame bool
-        innerIsSame, err = CheckTriggerNum(aZAPI, bZAPI, host)
+        innerIsSame, err = CheckTriggerNum(ctx, aZAPI, bZAPI, host)
         if err != nil {
             return false, err
         }
@@ -1114,22 +1308,25 @@ func CheckTriggerNumGroup(aZAPI, bZAPI *ZabbixAPI, hostgroup string) (bool, erro
     return isSame, nil
 }
 
-func CheckValuemap(aZAPI, bZAPI *ZabbixAPI) (bool, error) {
+func CheckValuemap(ctx context.Context, aZAPI, bZAPI *ZabbixAPI) (bool, error) {
+    if aZAPI.Caps().GlobalValuemaps != bZAPI.Caps().GlobalValuemaps {
+        return false, fmt.Errorf("cannot check valuemaps between zabbix %s and %s, since 5.4 they belong to templates and hosts", aZAPI.Version, bZAPI.Version)
+    }
     aParams := make(map[string]interface{}, 0)
     aParams["output"] = "extend"
-    aValuemapList, err := aZAPI.Valuemap("get", aParams)
+    aValuemapList, err := aZAPI.Valuemap(ctx, "get", aParams)
     if err != nil {
         return false, err
     }
 
     bParams := make(map[string]interface{}, 0)
     bParams["output"] = "extend"
-    bValuemapList, err := bZAPI.Valuemap("get", bParams)
+    bValuemapList, err := bZAPI.Valuemap(ctx, "get", bParams)
     if err != nil {
         return false, err
     }
 
-    mFilter := []string {"valuemapid"}
+    mFilter := []string {"valuemapid", "hostid", "uuid"}
     FilterZUM(aValuemapList, mFilter)
     FilterZUM(bValuemapList, mFilter)
     isSame, err := DiffUnitList(aValuemapList, bValuemapList, true)
@@ -1140,6 +1337,6 @@ func CheckValuemap(aZAPI, bZAPI *ZabbixAPI) (bool, error) {
     return isSame, nil
 }
 
-func CheckMap(aZAPI, bZAPI *ZabbixAPI) (bool, error) {
+func CheckMap(ctx context.Context, aZAPI, bZAPI *ZabbixAPI) (bool, error) {
     return false, errors.New("not support for map check, please manually")
 }
@@ -0,0 +1,525 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "time"
+)
+
+// parquet physical types, converted types and the other enums of the format
+const (
+    ParquetInt32     int32 = 1
+    ParquetInt64     int32 = 2
+    ParquetDouble    int32 = 5
+    ParquetByteArray int32 = 6
+
+    ParquetConvertedNone   int32 = -1
+    ParquetConvertedUTF8   int32 = 0
+    ParquetConvertedUint64 int32 = 14
+
+    parquetRequired     int32 = 0
+    parquetDataPage     int32 = 0
+    parquetPlain        int32 = 0
+    parquetRLE          int32 = 3
+    parquetCodecGzip    int32 = 2
+)
+
+const parquetMagic = "PAR1"
+
+const DefaultParquetRowGroup = 100000
+
+// thrift compact protocol types
+const (
+    thriftI32    byte = 5
+    thriftI64    byte = 6
+    thriftBinary byte = 8
+    thriftList   byte = 9
+    thriftStruct byte = 12
+)
+
+// thriftWriter encodes the structs of the parquet metadata by the thrift
+// compact protocol, only the parts used by ParquetWriter.
+type thriftWriter struct {
+    buf     bytes.Buffer
+    last    []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+    var b [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(b[:], v)
+    t.buf.Write(b[:n])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+    t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+    last := t.last[len(t.last)-1]
+    if delta := id - last; delta > 0 && delta <= 15 {
+        t.buf.WriteByte(byte(delta)<<4 | typ)
+    } else {
+        t.buf.WriteByte(typ)
+        t.zigzag(int64(id))
+    }
+    t.last[len(t.last)-1] = id
+}
+
+func (t *thriftWriter) I32(id int16, v int32) {
+    t.field(id, thriftI32)
+    t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) I64(id int16, v int64) {
+    t.field(id, thriftI64)
+    t.zigzag(v)
+}
+
+func (t *thriftWriter) String(id int16, s string) {
+    t.field(id, thriftBinary)
+    t.varint(uint64(len(s)))
+    t.buf.WriteString(s)
+}
+
+// List starts a list field, its elements follow without field headers.
+func (t *thriftWriter) List(id int16, elemType byte, size int) {
+    t.field(id, thriftList)
+    if size < 15 {
+        t.buf.WriteByte(byte(size)<<4 | elemType)
+        return
+    }
+    t.buf.WriteByte(0xf0 | elemType)
+    t.varint(uint64(size))
+}
+
+func (t *thriftWriter) ElemI32(v int32) {
+    t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) ElemString(s string) {
+    t.varint(uint64(len(s)))
+    t.buf.WriteString(s)
+}
+
+// Struct starts a struct field, or a list element with id 0.
+func (t *thriftWriter) Struct(id int16) {
+    if id != 0 {
+        t.field(id, thriftStruct)
+    }
+    t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) End() {
+    t.buf.WriteByte(0)
+    t.last = t.last[:len(t.last)-1]
+}
+
+func newThriftWriter() *thriftWriter {
+    return &thriftWriter{last: []int16{0}}
+}
+
+type ParquetColumn struct {
+    Name        string
+    Type        int32
+    Converted   int32
+}
+
+type parquetChunk struct {
+    offset          int64
+    numValues       int64
+    compressed      int64
+    uncompressed    int64
+}
+
+type parquetRowGroup struct {
+    numRows int64
+    chunks  []parquetChunk
+}
+
+// ParquetWriter writes rows of required flat columns as a parquet file, the
+// values are plain encoded in one gzip data page per column and row group.
+// The row values are int32, int64, float64 or string, a uint64 column takes
+// the decimal string of RowConverter.
+type ParquetWriter struct {
+    Columns         []ParquetColumn
+    RowGroupRows    int
+
+    w           io.Writer
+    offset      int64
+    rows        [][]interface{}
+    numRows     int64
+    rowGroups   []parquetRowGroup
+}
+
+func NewParquetWriter(w io.Writer, columns []ParquetColumn, rowGroupRows int) (*ParquetWriter, error) {
+    if rowGroupRows <= 0 {
+        rowGroupRows = DefaultParquetRowGroup
+    }
+    p := &ParquetWriter{
+        Columns: columns,
+        RowGroupRows: rowGroupRows,
+        w: w,
+        rows: make([][]interface{}, 0),
+    }
+    return p, p.write([]byte(parquetMagic))
+}
+
+func (p *ParquetWriter) write(b []byte) error {
+    n, err := p.w.Write(b)
+    p.offset += int64(n)
+    return err
+}
+
+func (p *ParquetWriter) Write(row []interface{}) error {
+    if len(row) != len(p.Columns) {
+        return fmt.Errorf("parquet row has %d values for %d columns", len(row), len(p.Columns))
+    }
+    p.rows = append(p.rows, row)
+    if len(p.rows) >= p.RowGroupRows {
+        return p.flush()
+    }
+    return nil
+}
+
+func plainValue(buf *bytes.Buffer, column ParquetColumn, v interface{}) error {
+    var b [8]byte
+    switch column.Type {
+    case ParquetInt32:
+        i, ok := v.(int32)
+        if !ok {
+            return fmt.Errorf("parquet column %s needs int32, got %T", column.Name, v)
+        }
+        binary.LittleEndian.PutUint32(b[:4], uint32(i))
+        buf.Write(b[:4])
+    case ParquetInt64:
+        var u uint64
+        switch i := v.(type) {
+        case int64:
+            u = uint64(i)
+        case string:
+            n, err := strconv.ParseUint(i, 10, 64)
+            if err != nil {
+                return fmt.Errorf("parquet column %s: %s", column.Name, err)
+            }
+            u = n
+        default:
+            return fmt.Errorf("parquet column %s needs int64, got %T", column.Name, v)
+        }
+        binary.LittleEndian.PutUint64(b[:], u)
+        buf.Write(b[:])
+    case ParquetDouble:
+        f, ok := v.(float64)
+        if !ok {
+            return fmt.Errorf("parquet column %s needs float64, got %T", column.Name, v)
+        }
+        binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+        buf.Write(b[:])
+    case ParquetByteArray:
+        s, ok := v.(string)
+        if !ok {
+            return fmt.Errorf("parquet column %s needs string, got %T", column.Name, v)
+        }
+        binary.LittleEndian.PutUint32(b[:4], uint32(len(s)))
+        buf.Write(b[:4])
+        buf.WriteString(s)
+    default:
+        return fmt.Errorf("cannot support parquet type %d", column.Type)
+    }
+    return nil
+}
+
+func (p *ParquetWriter) flush() error {
+    if len(p.rows) == 0 {
+        return nil
+    }
+    group := parquetRowGroup{numRows: int64(len(p.rows))}
+    for idx, column := range p.Columns {
+        var raw bytes.Buffer
+        for _, row := range p.rows {
+            err := plainValue(&raw, column, row[idx])
+            if err != nil {
+                return err
+            }
+        }
+        var data bytes.Buffer
+        gz := gzip.NewWriter(&data)
+        _, err := gz.Write(raw.Bytes())
+        if err != nil {
+            return err
+        }
+        err = gz.Close()
+        if err != nil {
+            return err
+        }
+
+        header := newThriftWriter()
+        header.I32(1, parquetDataPage)
+        header.I32(2, int32(raw.Len()))
+        header.I32(3, int32(data.Len()))
+        header.Struct(5)
+        header.I32(1, int32(len(p.rows)))
+        header.I32(2, parquetPlain)
+        header.I32(3, parquetRLE)
+        header.I32(4, parquetRLE)
+        header.End()
+        header.buf.WriteByte(0)
+
+        chunk := parquetChunk{
+            offset: p.offset,
+            numValues: int64(len(p.rows)),
+            compressed: int64(header.buf.Len() + data.Len()),
+            uncompressed: int64(header.buf.Len() + raw.Len()),
+        }
+        err = p.write(header.buf.Bytes())
+        if err != nil {
+            return err
+        }
+        err = p.write(data.Bytes())
+        if err != nil {
+            return err
+        }
+        group.chunks = append(group.chunks, chunk)
+    }
+    p.rowGroups = append(p.rowGroups, group)
+    p.numRows += group.numRows
+    p.rows = p.rows[:0]
+    return nil
+}
+
+// Close writes the last row group and the footer, not the underlying writer.
+func (p *ParquetWriter) Close() error {
+    err := p.flush()
+    if err != nil {
+        return err
+    }
+
+    meta := newThriftWriter()
+    meta.I32(1, 1)
+    meta.List(2, thriftStruct, len(p.Columns)+1)
+    meta.Struct(0)
+    meta.String(4, "schema")
+    meta.I32(5, int32(len(p.Columns)))
+    meta.End()
+    for _, column := range p.Columns {
+        meta.Struct(0)
+        meta.I32(1, column.Type)
+        meta.I32(3, parquetRequired)
+        meta.String(4, column.Name)
+        if column.Converted != ParquetConvertedNone {
+            meta.I32(6, column.Converted)
+        }
+        meta.End()
+    }
+    meta.I64(3, p.numRows)
+    meta.List(4, thriftStruct, len(p.rowGroups))
+    for _, group := range p.rowGroups {
+        var totalSize int64
+        meta.Struct(0)
+        meta.List(1, thriftStruct, len(group.chunks))
+        for idx, chunk := range group.chunks {
+            column := p.Columns[idx]
+            totalSize += chunk.uncompressed
+            meta.Struct(0)
+            meta.I64(2, chunk.offset)
+            meta.Struct(3)
+            meta.I32(1, column.Type)
+            meta.List(2, thriftI32, 2)
+            meta.ElemI32(parquetPlain)
+            meta.ElemI32(parquetRLE)
+            meta.List(3, thriftBinary, 1)
+            meta.ElemString(column.Name)
+            meta.I32(4, parquetCodecGzip)
+            meta.I64(5, chunk.numValues)
+            meta.I64(6, chunk.uncompressed)
+            meta.I64(7, chunk.compressed)
+            meta.I64(9, chunk.offset)
+            meta.End()
+            meta.End()
+        }
+        meta.I64(2, totalSize)
+        meta.I64(3, group.numRows)
+        meta.End()
+    }
+    meta.String(6, "zabbix-migrate")
+    meta.buf.WriteByte(0)
+
+    err = p.write(meta.buf.Bytes())
+    if err != nil {
+        return err
+    }
+    var size [4]byte
+    binary.LittleEndian.PutUint32(size[:], uint32(meta.buf.Len()))
+    err = p.write(size[:])
+    if err != nil {
+        return err
+    }
+    return p.write([]byte(parquetMagic))
+}
+
+// ParquetColumns is the schema of the parquet export of the table, host,
+// key_ and value_type of the item followed by the columns of the table
+// without itemid.
+func ParquetColumns(table string) ([]ParquetColumn, error) {
+    specs, ok := TableSpecs[table]
+    if !ok {
+        return nil, fmt.Errorf("cannot support export for the table %s", table)
+    }
+    res := []ParquetColumn{
+        {"host", ParquetByteArray, ParquetConvertedUTF8},
+        {"key_", ParquetByteArray, ParquetConvertedUTF8},
+        {"value_type", ParquetInt32, ParquetConvertedNone},
+    }
+    for _, spec := range specs[1:] {
+        switch spec.Kind {
+        case ColumnInt:
+            res = append(res, ParquetColumn{spec.Name, ParquetInt64, ParquetConvertedNone})
+        case ColumnUint:
+            res = append(res, ParquetColumn{spec.Name, ParquetInt64, ParquetConvertedUint64})
+        case ColumnFloat:
+            res = append(res, ParquetColumn{spec.Name, ParquetDouble, ParquetConvertedNone})
+        case ColumnString:
+            res = append(res, ParquetColumn{spec.Name, ParquetByteArray, ParquetConvertedUTF8})
+        }
+    }
+    return res, nil
+}
+
+// TableValueType is the value_type of the items stored in the table.
+func TableValueType(table string) (int, bool) {
+    for valueType, t := range ValueTypeHistory {
+        if t == table {
+            return valueType, true
+        }
+    }
+    for valueType, t := range ValueTypeTrends {
+        if t == table {
+            return valueType, true
+        }
+    }
+    return 0, false
+}
+
+type parquetPart struct {
+    day     string
+    file    *os.File
+    pw      *ParquetWriter
+}
+
+// ParquetExportWriter writes the rows of one table of one host into parquet
+// files partitioned by host and day of the clock, laid out as
+// <dir>/<table>/host=<host>/day=<yyyy-mm-dd>/<hostid>.parquet. The rows come
+// day by day as a DayWriter, so the part of one day is open at a time.
+type ParquetExportWriter struct {
+    Dir             string
+    Table           string
+    Hostid          int
+    Host            string
+    RowGroupRows    int
+    Columns         []ParquetColumn
+
+    valueType   int32
+    part        *parquetPart
+    closed      map[string]bool
+    files       int
+}
+
+func NewParquetExportWriter(dir string, table string, hostid int, host string, rowGroupRows int) (*ParquetExportWriter, error) {
+    columns, err := ParquetColumns(table)
+    if err != nil {
+        return nil, err
+    }
+    valueType, ok := TableValueType(table)
+    if !ok {
+        return nil, errors.New("cannot find value_type of the table " + table)
+    }
+    return &ParquetExportWriter{
+        Dir: dir,
+        Table: table,
+        Hostid: hostid,
+        Host: host,
+        RowGroupRows: rowGroupRows,
+        Columns: columns,
+        valueType: int32(valueType),
+        closed: make(map[string]bool),
+    }, nil
+}
+
+// Write adds the row converted from the table, its first column is the itemid.
+// A row of another day closes the open part, a closed day can not be opened
+// again since parquet files are not appended.
+func (w *ParquetExportWriter) Write(key string, row []interface{}) error {
+    clock, ok := row[1].(int64)
+    if !ok {
+        return fmt.Errorf("parquet export needs int64 clock, got %T", row[1])
+    }
+    day := time.Unix(clock, 0).UTC().Format("2006-01-02")
+    if w.part != nil && w.part.day != day {
+        err := w.EndDay()
+        if err != nil {
+            return err
+        }
+    }
+    if w.part == nil {
+        if w.closed[day] {
+            return fmt.Errorf("parquet part of day %s is already closed", day)
+        }
+        path := filepath.Join(
+            w.Dir,
+            w.Table,
+            "host="+exportNameReplacer.ReplaceAllString(w.Host, "_"),
+            "day="+day,
+            fmt.Sprintf("%d.parquet", w.Hostid),
+        )
+        err := os.MkdirAll(filepath.Dir(path), 0755)
+        if err != nil {
+            return err
+        }
+        file, err := os.Create(path)
+        if err != nil {
+            return err
+        }
+        pw, err := NewParquetWriter(file, w.Columns, w.RowGroupRows)
+        if err != nil {
+            file.Close()
+            return err
+        }
+        w.part = &parquetPart{day: day, file: file, pw: pw}
+        w.files++
+    }
+
+    values := make([]interface{}, 0, len(w.Columns))
+    values = append(values, w.Host, key, w.valueType)
+    values = append(values, row[1:]...)
+    return w.part.pw.Write(values)
+}
+
+// EndDay writes the footer of the open part and closes its file.
+func (w *ParquetExportWriter) EndDay() error {
+    part := w.part
+    if part == nil {
+        return nil
+    }
+    w.part = nil
+    w.closed[part.day] = true
+    err := part.pw.Close()
+    if e := part.file.Close(); err == nil {
+        err = e
+    }
+    return err
+}
+
+func (w *ParquetExportWriter) Parts() int {
+    return w.files
+}
+
+func (w *ParquetExportWriter) Close() error {
+    return w.EndDay()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// thriftRead decodes a thrift compact struct into its fields by id, enough
+// to check the metadata written by ParquetWriter
+func thriftRead(t *testing.T, r *bytes.Reader) map[int16]interface{} {
+    res := make(map[int16]interface{})
+    var last int16
+    for {
+        b, _ := r.ReadByte()
+        if b == 0 {
+            return res
+        }
+        typ := b & 0x0f
+        id := last + int16(b>>4)
+        if b>>4 == 0 {
+            v, _ := binary.ReadVarint(r)
+            id = int16(v)
+        }
+        last = id
+        res[id] = thriftValue(t, r, typ)
+    }
+}
+
+func thriftValue(t *testing.T, r *bytes.Reader, typ byte) interface{} {
+    switch typ {
+    case 5, 6:
+        v, _ := binary.ReadVarint(r)
+        return v
+    case 8:
+        n, _ := binary.ReadUvarint(r)
+        b := make([]byte, n)
+        r.Read(b)
+        return string(b)
+    case 9:
+        h, _ := r.ReadByte()
+        size := uint64(h >> 4)
+        if size == 15 {
+            size, _ = binary.ReadUvarint(r)
+        }
+        res := make([]interface{}, size)
+        for i := range res {
+            res[i] = thriftValue(t, r, h&0x0f)
+        }
+        return res
+    case 12:
+        return thriftRead(t, r)
+    }
+    t.Fatalf("unexpected thrift type %d", typ)
+    return nil
+}
+
+func TestParquetWriter(t *testing.T) {
+    var buf bytes.Buffer
+    columns, _ := ParquetColumns("history_uint")
+    pw, err := NewParquetWriter(&buf, columns, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 3; i++ {
+        err = pw.Write([]interface{}{"Zabbix server", "vm.memory.size[total]", int32(ValueTypeUint), int64(1600000000 + i), "18446744073709551615", int64(i)})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    err = pw.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    data := buf.Bytes()
+    if string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+        t.Fatal("expect parquet magic at begin and end")
+    }
+    size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+    meta := thriftRead(t, bytes.NewReader(data[len(data)-8-size : len(data)-8]))
+    if meta[3].(int64) != 3 {
+        t.Fatalf("expect 3 rows, got %v", meta[3])
+    }
+    schema := meta[2].([]interface{})
+    if len(schema) != 7 || schema[1].(map[int16]interface{})[4] != "host" || schema[5].(map[int16]interface{})[6].(int64) != int64(ParquetConvertedUint64) {
+        t.Fatalf("unexpected parquet schema: %v", schema)
+    }
+    groups := meta[4].([]interface{})
+    if len(groups) != 2 || groups[1].(map[int16]interface{})[3].(int64) != 1 {
+        t.Fatalf("unexpected parquet row groups: %v", groups)
+    }
+
+    // read back the value column of the first row group
+    chunk := groups[0].(map[int16]interface{})[1].([]interface{})[4].(map[int16]interface{})[3].(map[int16]interface{})
+    r := bytes.NewReader(data[chunk[9].(int64):])
+    header := thriftRead(t, r)
+    page := make([]byte, header[3].(int64))
+    r.Read(page)
+    gz, err := gzip.NewReader(bytes.NewReader(page))
+    if err != nil {
+        t.Fatal(err)
+    }
+    raw, _ := ioutil.ReadAll(gz)
+    if len(raw) != 16 || binary.LittleEndian.Uint64(raw[8:]) != 18446744073709551615 {
+        t.Fatalf("unexpected parquet page of value: %v", raw)
+    }
+}
+
+// parquetGolden are the rows of the files in testdata, written with row
+// groups of 2 rows.
+var parquetGolden = map[string][][]interface{}{
+    "history_uint": {
+        {"Zabbix server", "vm.memory.size[total]", int32(ValueTypeUint), int64(1600000000), "0", int64(0)},
+        {"Zabbix server", "vm.memory.size[total]", int32(ValueTypeUint), int64(1600000001), "42", int64(1)},
+        {"Zabbix server", "vm.memory.size[total]", int32(ValueTypeUint), int64(1600000002), "18446744073709551615", int64(999999999)},
+    },
+    "history_log": {
+        {"Zabbix server", "eventlog[Application]", int32(ValueTypeLog), int64(1600000000), int64(1599999999), "MSSQLSERVER", int64(4), "Login failed for user 'sa'.", int64(18456), int64(5)},
+        {"Zabbix server", "log[/var/log/messages]", int32(ValueTypeLog), int64(1600000060), int64(0), "", int64(0), "", int64(0), int64(0)},
+        {"Zabbix server", "log[/var/log/messages]", int32(ValueTypeLog), int64(1600000120), int64(0), "", int64(0), "ошибка диска\tsda", int64(0), int64(7)},
+    },
+    "trends": {
+        {"Zabbix server", "system.cpu.load[all,avg1]", int32(ValueTypeFloat), int64(1600000000), int64(60), -0.5, 0.25, 1e10},
+        {"Zabbix server", "system.cpu.load[all,avg1]", int32(ValueTypeFloat), int64(1600003600), int64(59), 0.0, 1.0 / 3, 2.5},
+    },
+}
+
+func parquetGoldenFile(t *testing.T, table string) []byte {
+    var buf bytes.Buffer
+    columns, err := ParquetColumns(table)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pw, err := NewParquetWriter(&buf, columns, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, row := range parquetGolden[table] {
+        err = pw.Write(row)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err = pw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+// TestParquetGolden compares the files with the ones in testdata, which have
+// been read back with the rows of parquetGolden by parquet-go/parquet-go
+// v0.32.0 and apache arrow-go v18.8.0, the uint64 value as UINT_64. A change
+// of the writer needs new files read by them again.
+func TestParquetGolden(t *testing.T) {
+    for table := range parquetGolden {
+        expect, err := ioutil.ReadFile(filepath.Join("testdata", table+".parquet"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if data := parquetGoldenFile(t, table); !bytes.Equal(data, expect) {
+            t.Errorf("parquet file of %s differs from testdata/%s.parquet", table, table)
+        }
+    }
+}
+
+// TestParquetPyarrow reads the file back by a parquet reader of its own,
+// it needs python3 with pyarrow.
+func TestParquetPyarrow(t *testing.T) {
+    if err := exec.Command("python3", "-c", "import pyarrow.parquet").Run(); err != nil {
+        t.Skipf("python3 with pyarrow is not ready: %s", err)
+    }
+    dir, err := ioutil.TempDir("", "zabbix_parquet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "history_uint.parquet")
+    file, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    columns, _ := ParquetColumns("history_uint")
+    pw, err := NewParquetWriter(file, columns, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    values := []string{"0", "42", "18446744073709551615"}
+    for i, v := range values {
+        err = pw.Write([]interface{}{"Zabbix server", "vm.memory.size[total]", int32(ValueTypeUint), int64(1600000000 + i), v, int64(i)})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err = pw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    file.Close()
+
+    script := `
+import sys
+import pyarrow.parquet as pq
+t = pq.read_table(sys.argv[1])
+print(",".join(str(f.type) for f in t.schema))
+for row in t.to_pylist():
+    print("|".join(str(row[f.name]) for f in t.schema))
+`
+    out, err := exec.Command("python3", "-c", script, path).CombinedOutput()
+    if err != nil {
+        t.Fatalf("pyarrow cannot read the parquet file: %s: %s", err, out)
+    }
+    lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+    if len(lines) != 4 || lines[0] != "string,string,int32,int64,uint64,int64" {
+        t.Fatalf("unexpected pyarrow schema: %q", lines)
+    }
+    for i, v := range values {
+        expect := fmt.Sprintf("Zabbix server|vm.memory.size[total]|%d|%d|%s|%d", ValueTypeUint, 1600000000+i, v, i)
+        if lines[i+1] != expect {
+            t.Fatalf("unexpected pyarrow row %q, expect %q", lines[i+1], expect)
+        }
+    }
+}
+
+func TestParquetExportDays(t *testing.T) {
+    dir, err := ioutil.TempDir("", "zabbix_parquet")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    w, err := NewParquetExportWriter(dir, "history", 10084, "Zabbix server", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    day1, day2 := int64(1600041600), int64(1600128000)
+    for _, clock := range []int64{day1, day1 + 60, day2} {
+        err = w.Write("system.cpu.load", []interface{}{int64(100), clock, 1.5, int64(0)})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    // the part of the first day is done once the rows moved on
+    if w.part == nil || w.part.day != "2020-09-15" || !w.closed["2020-09-14"] {
+        t.Fatalf("unexpected open part %v, closed %v", w.part, w.closed)
+    }
+    data, err := ioutil.ReadFile(filepath.Join(dir, "history", "host=Zabbix_server", "day=2020-09-14", "10084.parquet"))
+    if err != nil || len(data) < 8 || string(data[len(data)-4:]) != "PAR1" {
+        t.Fatalf("expect closed parquet file of the first day: %v", err)
+    }
+    if err = w.Write("system.cpu.load", []interface{}{int64(100), day1 + 120, 1.5, int64(0)}); err == nil {
+        t.Fatal("expect a row of a closed day to fail")
+    }
+    if err = w.Close(); err != nil || w.Parts() != 2 {
+        t.Fatalf("unexpected close with %d parts: %v", w.Parts(), err)
+    }
+}
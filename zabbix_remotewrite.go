@@ -0,0 +1,303 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/golang/snappy"
+    log "github.com/sirupsen/logrus"
+)
+
+const DefaultRemoteWriteBatch = 2000
+
+var (
+    promNameReplacer  = regexp.MustCompile(`[^a-zA-Z0-9_:]+`)
+    promLabelReplacer = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+)
+
+type PromLabel struct {
+    Name    string
+    Value   string
+}
+
+// PromSample is one value at the timestamp in milliseconds.
+type PromSample struct {
+    Value       float64
+    Timestamp   int64
+}
+
+type PromSeries struct {
+    Labels  []PromLabel
+    Samples []PromSample
+}
+
+// PromMetricName derives the metric name from the item key, the parameters
+// in brackets are left to the key label.
+func PromMetricName(key string) string {
+    if i := strings.IndexByte(key, '['); i >= 0 {
+        key = key[:i]
+    }
+    return "zabbix_" + strings.Trim(promNameReplacer.ReplaceAllString(key, "_"), "_")
+}
+
+func PromLabelName(name string) string {
+    return promLabelReplacer.ReplaceAllString(name, "_")
+}
+
+func protoKey(buf *bytes.Buffer, field int, wireType int) {
+    protoVarint(buf, uint64(field<<3|wireType))
+}
+
+func protoVarint(buf *bytes.Buffer, v uint64) {
+    var b [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(b[:], v)
+    buf.Write(b[:n])
+}
+
+func protoBytes(buf *bytes.Buffer, field int, b []byte) {
+    protoKey(buf, field, 2)
+    protoVarint(buf, uint64(len(b)))
+    buf.Write(b)
+}
+
+// EncodeWriteRequest encodes the series as the protobuf WriteRequest of the
+// prometheus remote write protocol.
+func EncodeWriteRequest(series []PromSeries) []byte {
+    var req bytes.Buffer
+    for _, s := range series {
+        var ts bytes.Buffer
+        for _, label := range s.Labels {
+            var l bytes.Buffer
+            protoBytes(&l, 1, []byte(label.Name))
+            protoBytes(&l, 2, []byte(label.Value))
+            protoBytes(&ts, 1, l.Bytes())
+        }
+        for _, sample := range s.Samples {
+            var smp bytes.Buffer
+            var b [8]byte
+            protoKey(&smp, 1, 1)
+            binary.LittleEndian.PutUint64(b[:], math.Float64bits(sample.Value))
+            smp.Write(b[:])
+            protoKey(&smp, 2, 0)
+            protoVarint(&smp, uint64(sample.Timestamp))
+            protoBytes(&ts, 2, smp.Bytes())
+        }
+        protoBytes(&req, 1, ts.Bytes())
+    }
+    return req.Bytes()
+}
+
+// RemoteWriteClient posts series to a prometheus remote write endpoint, the
+// requests failed by 5xx or 429 are retried with backoff.
+type RemoteWriteClient struct {
+    URL     string
+    Client  *http.Client
+    Retries int
+}
+
+func NewRemoteWriteClient(url string) *RemoteWriteClient {
+    return &RemoteWriteClient{
+        URL: url,
+        Client: &http.Client{
+            Timeout: 30 * time.Second,
+        },
+        Retries: 3,
+    }
+}
+
+func (c *RemoteWriteClient) Send(series []PromSeries) error {
+    body := snappy.Encode(nil, EncodeWriteRequest(series))
+    return postRetry(c.Client, c.URL, c.Retries, body, map[string]string{
+        "Content-Encoding": "snappy",
+        "Content-Type": "application/x-protobuf",
+        "X-Prometheus-Remote-Write-Version": "0.1.0",
+    })
+}
+
+// postRetry posts the body to the url, the requests failed by the network or
+// a retryStatus are retried up to retries times with backoff.
+func postRetry(client *http.Client, url string, retries int, body []byte, header map[string]string) error {
+    return retryCall(context.Background(), fmt.Sprintf("post to [%s]", url), retries, DefaultRetryWait, func() (bool, error) {
+        return post(client, url, body, header)
+    })
+}
+
+func post(client *http.Client, url string, body []byte, header map[string]string) (bool, error) {
+    req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    for name, value := range header {
+        req.Header.Set(name, value)
+    }
+
+    rsp, err := client.Do(req)
+    if err != nil {
+        return true, err
+    }
+    defer rsp.Body.Close()
+    if rsp.StatusCode/100 == 2 {
+        io.Copy(ioutil.Discard, rsp.Body)
+        return false, nil
+    }
+    msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 512))
+    err = fmt.Errorf("post status %s: %s", rsp.Status, strings.TrimSpace(string(msg)))
+    return retryStatus(rsp.StatusCode), err
+}
+
+// RemoteWriteExportWriter turns the numeric history of one host into series
+// of the remote write protocol, labeled by host, host groups, item key and
+// item tags, and sends them every Batch samples. The samples of an item are
+// sent in order of their clock, the receiver has to accept samples that old.
+// Timestamps are in milliseconds, so only the first value of an item in a
+// millisecond is sent, the receiver rejects a repeated timestamp.
+type RemoteWriteExportWriter struct {
+    Client  *RemoteWriteClient
+    Table   string
+    Host    string
+    Groups  []string
+    Tags    map[int]map[string]string
+    Batch   int
+
+    series      map[int]*PromSeries
+    order       []int
+    last        map[int]int64
+    samples     int
+    dropped     int
+    requests    int
+}
+
+// NewRemoteWriteExportWriter returns nil for the tables which are not numeric.
+func NewRemoteWriteExportWriter(aZDB *ZabbixDB, client *RemoteWriteClient, table string, hostid int, host string, batch int) (*RemoteWriteExportWriter, error) {
+    if table != "history" && table != "history_uint" {
+        return nil, nil
+    }
+    groups, err := aZDB.GetHostGroupNames(hostid)
+    if err != nil {
+        return nil, err
+    }
+    tags, err := aZDB.GetItemTags(hostid)
+    if err != nil {
+        return nil, err
+    }
+    if batch <= 0 {
+        batch = DefaultRemoteWriteBatch
+    }
+    return &RemoteWriteExportWriter{
+        Client: client,
+        Table: table,
+        Host: host,
+        Groups: groups,
+        Tags: tags,
+        Batch: batch,
+        series: make(map[int]*PromSeries),
+        last: make(map[int]int64),
+    }, nil
+}
+
+func (w *RemoteWriteExportWriter) labels(itemid int, key string) []PromLabel {
+    res := []PromLabel{
+        {"__name__", PromMetricName(key)},
+        {"host", w.Host},
+        {"key", key},
+    }
+    if len(w.Groups) > 0 {
+        res = append(res, PromLabel{"hostgroup", strings.Join(w.Groups, ",")})
+    }
+    // tags which differ only by the characters replaced in label names are
+    // joined into one label, a series must not repeat a label name
+    tags := make(map[string][]string)
+    for tag, value := range w.Tags[itemid] {
+        name := "tag_" + PromLabelName(tag)
+        tags[name] = append(tags[name], value)
+    }
+    for name, values := range tags {
+        sort.Strings(values)
+        res = append(res, PromLabel{name, strings.Join(values, ",")})
+    }
+    sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+    return res
+}
+
+// Write adds the row converted from the table, its first column is the itemid.
+func (w *RemoteWriteExportWriter) Write(key string, row []interface{}) error {
+    itemid := int(row[0].(int64))
+    var value float64
+    switch v := row[2].(type) {
+    case float64:
+        value = v
+    case string:
+        u, err := strconv.ParseUint(v, 10, 64)
+        if err != nil {
+            return err
+        }
+        value = float64(u)
+    }
+
+    timestamp := row[1].(int64)*1000 + row[3].(int64)/1000000
+    if last, ok := w.last[itemid]; ok && timestamp <= last {
+        w.dropped++
+        return nil
+    }
+    w.last[itemid] = timestamp
+
+    s, ok := w.series[itemid]
+    if !ok {
+        s = &PromSeries{Labels: w.labels(itemid, key)}
+        w.series[itemid] = s
+        w.order = append(w.order, itemid)
+    }
+    s.Samples = append(s.Samples, PromSample{
+        Value: value,
+        Timestamp: timestamp,
+    })
+    w.samples++
+    if w.samples >= w.Batch {
+        return w.flush()
+    }
+    return nil
+}
+
+func (w *RemoteWriteExportWriter) flush() error {
+    if w.samples == 0 {
+        return nil
+    }
+    series := make([]PromSeries, 0, len(w.order))
+    for _, itemid := range w.order {
+        series = append(series, *w.series[itemid])
+    }
+    err := w.Client.Send(series)
+    if err != nil {
+        return err
+    }
+    w.requests++
+    w.series = make(map[int]*PromSeries)
+    w.order = w.order[:0]
+    w.samples = 0
+    return nil
+}
+
+func (w *RemoteWriteExportWriter) Parts() int {
+    return w.requests
+}
+
+func (w *RemoteWriteExportWriter) Close() error {
+    if w.dropped > 0 {
+        log.WithFields(log.Fields{
+            "func": "RemoteWriteExportWriter.Close",
+            "step": "dropped",
+        }).Infof("drop %d samples of %s host [%s] in the millisecond of a sample before", w.dropped, w.Table, w.Host)
+    }
+    return w.flush()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/golang/snappy"
+)
+
+func TestRemoteWrite(t *testing.T) {
+    if name := PromMetricName("system.cpu.util[,user]"); name != "zabbix_system_cpu_util" {
+        t.Errorf("metric name = %s", name)
+    }
+
+    var bodies [][]byte
+    fails := 1
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+            t.Errorf("headers = %v", r.Header)
+        }
+        if fails > 0 {
+            fails--
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        buf, _ := ioutil.ReadAll(r.Body)
+        body, err := snappy.Decode(nil, buf)
+        if err != nil {
+            t.Error(err)
+        }
+        bodies = append(bodies, body)
+    }))
+    defer srv.Close()
+
+    client := NewRemoteWriteClient(srv.URL)
+    w := &RemoteWriteExportWriter{
+        Client: client,
+        Table: "history_uint",
+        Host: "web-01",
+        Groups: []string{"Linux servers"},
+        Tags: map[int]map[string]string{1: {"component": "cpu"}},
+        Batch: 2,
+        series: make(map[int]*PromSeries),
+        last: make(map[int]int64),
+    }
+    rows := [][]interface{}{
+        {int64(1), int64(100), "5", int64(0)},
+        {int64(1), int64(160), "6", int64(500000000)},
+        // the same millisecond as the sample before
+        {int64(1), int64(160), "9", int64(500400000)},
+        {int64(2), int64(100), "7", int64(0)},
+    }
+    for _, row := range rows {
+        if err := w.Write("system.cpu.util[,user]", row); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if w.Parts() != 2 || len(bodies) != 2 || w.dropped != 1 {
+        t.Fatalf("requests = %d, received = %d, dropped = %d", w.Parts(), len(bodies), w.dropped)
+    }
+
+    want := EncodeWriteRequest([]PromSeries{{
+        Labels: []PromLabel{
+            {"__name__", "zabbix_system_cpu_util"},
+            {"host", "web-01"},
+            {"hostgroup", "Linux servers"},
+            {"key", "system.cpu.util[,user]"},
+            {"tag_component", "cpu"},
+        },
+        Samples: []PromSample{{5, 100000}, {6, 160500}},
+    }})
+    if !bytes.Equal(bodies[0], want) {
+        t.Errorf("request = %x, want %x", bodies[0], want)
+    }
+
+    // tag names which are one label name are joined
+    w.Tags[3] = map[string]string{"app.name": "web", "app_name": "api,db"}
+    labels := w.labels(3, "agent.ping")
+    if len(labels) != 5 || labels[4] != (PromLabel{"tag_app_name", "api,db,web"}) {
+        t.Errorf("labels = %v", labels)
+    }
+}
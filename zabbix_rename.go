@@ -0,0 +1,139 @@
+package main
+
+import (
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+
+    "gopkg.in/yaml.v2"
+)
+
+// KeyRename renames the item key Old to New. Old is matched literally, with
+// the prefix "re:" it is a regexp over the whole key and New may refer to its
+// groups like $1.
+type KeyRename struct {
+    Old     string  `yaml:"old"`
+    New     string  `yaml:"new"`
+    re      *regexp.Regexp
+}
+
+// RenameMap is the old host and item key to the new one, for the history of
+// hosts and items which are renamed on the new zabbix.
+type RenameMap struct {
+    Hosts   map[string]string   `yaml:"hosts"`
+    Keys    []KeyRename         `yaml:"keys"`
+}
+
+// LoadRenameMap reads the rename map, a .yaml or .yml file has the fields of
+// RenameMap, any other file is csv with lines of "host,old,new" or
+// "key,old,new".
+func LoadRenameMap(path string) (*RenameMap, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        return ParseRenameYAML(file)
+    default:
+        return ParseRenameCSV(file)
+    }
+}
+
+func ParseRenameYAML(r io.Reader) (*RenameMap, error) {
+    buf, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    res := &RenameMap{}
+    err = yaml.UnmarshalStrict(buf, res)
+    if err != nil {
+        return nil, err
+    }
+    return res, res.compile()
+}
+
+func ParseRenameCSV(r io.Reader) (*RenameMap, error) {
+    reader := csv.NewReader(r)
+    reader.Comment = '#'
+    reader.FieldsPerRecord = 3
+    reader.TrimLeadingSpace = true
+
+    res := &RenameMap{Hosts: make(map[string]string)}
+    for num := 1; ; num++ {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        switch record[0] {
+        case "host":
+            res.Hosts[record[1]] = record[2]
+        case "key":
+            res.Keys = append(res.Keys, KeyRename{Old: record[1], New: record[2]})
+        default:
+            return nil, fmt.Errorf("rename map record %d: unknown kind [%s], support for host|key", num, record[0])
+        }
+    }
+    return res, res.compile()
+}
+
+func (m *RenameMap) compile() error {
+    for idx, rule := range m.Keys {
+        if rule.Old == "" {
+            return errors.New("rename map has a key rule without old key")
+        }
+        if !strings.HasPrefix(rule.Old, "re:") {
+            continue
+        }
+        re, err := regexp.Compile("^(?:" + strings.TrimPrefix(rule.Old, "re:") + ")$")
+        if err != nil {
+            return fmt.Errorf("rename map key rule [%s]: %s", rule.Old, err)
+        }
+        m.Keys[idx].re = re
+    }
+    return nil
+}
+
+// Host returns the name of the host on the new zabbix.
+func (m *RenameMap) Host(host string) string {
+    if m == nil {
+        return host
+    }
+    if newHost, ok := m.Hosts[host]; ok {
+        return newHost
+    }
+    return host
+}
+
+// Key returns the renamed key by the first matching rule, ok is false when no
+// rule matches.
+func (m *RenameMap) Key(key string) (string, bool) {
+    if m == nil {
+        return key, false
+    }
+    for _, rule := range m.Keys {
+        if rule.re == nil {
+            if rule.Old == key {
+                return rule.New, true
+            }
+            continue
+        }
+        match := rule.re.FindStringSubmatchIndex(key)
+        if match == nil {
+            continue
+        }
+        return string(rule.re.ExpandString(nil, rule.New, key, match)), true
+    }
+    return key, false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestRenameMap(t *testing.T) {
+    csvMap, err := ParseRenameCSV(strings.NewReader(`# kind,old,new
+host,old-web-01,web-01.example.com
+key,"system.cpu.util[,user]","system.cpu.util[,user,avg1]"
+key,"re:net\.if\.in\[(.*)\]","net.if.in[""$1"",bytes]"
+`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    yamlMap, err := ParseRenameYAML(strings.NewReader(`hosts:
+  old-web-01: web-01.example.com
+keys:
+  - old: system.cpu.util[,user]
+    new: system.cpu.util[,user,avg1]
+  - old: re:net\.if\.in\[(.*)\]
+    new: net.if.in["$1",bytes]
+`))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, m := range []*RenameMap{csvMap, yamlMap} {
+        if m.Host("old-web-01") != "web-01.example.com" || m.Host("db-01") != "db-01" {
+            t.Fatalf("unexpected host rename: %v", m.Hosts)
+        }
+        if key, ok := m.Key("system.cpu.util[,user]"); !ok || key != "system.cpu.util[,user,avg1]" {
+            t.Fatalf("unexpected key rename: %s", key)
+        }
+        if key, ok := m.Key("net.if.in[eth0]"); !ok || key != `net.if.in["eth0",bytes]` {
+            t.Fatalf("unexpected regexp key rename: %s", key)
+        }
+        if _, ok := m.Key("net.if.in[eth0].x"); ok {
+            t.Fatal("expect regexp to match the whole key")
+        }
+    }
+
+    var nilMap *RenameMap
+    if nilMap.Host("a") != "a" {
+        t.Fatal("expect nil rename map to keep host")
+    }
+    if _, err := ParseRenameCSV(strings.NewReader("item,a,b\n")); err == nil {
+        t.Fatal("expect unknown kind to fail")
+    }
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const DefaultRetryWait = time.Second
+
+// retryStatus is the http status of a failure which can pass when the same
+// request is sent again later, like an overloaded or restarting server.
+func retryStatus(status int) bool {
+    return status/100 == 5 || status == http.StatusTooManyRequests
+}
+
+// retryCall calls call until it passes, fails with retry false or has been
+// retried retries times, waiting from wait on and twice as long after each
+// attempt. The wait is aborted when the ctx is done. The call decides what is
+// retryable, a transport failure or a retryStatus of a request which can be
+// sent twice.
+func retryCall(ctx context.Context, name string, retries int, wait time.Duration, call func() (bool, error)) error {
+    backoff := wait
+    for attempt := 0; ; attempt++ {
+        retry, err := call()
+        if err == nil {
+            return nil
+        }
+        if !retry || attempt >= retries || ctx.Err() != nil {
+            return err
+        }
+        log.WithFields(log.Fields{
+            "func": "retryCall",
+            "step": "retry",
+        }).Warnf("%s is failed, retry in %s: %s", name, backoff, err)
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+    }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestRetryCall(t *testing.T) {
+    calls := 0
+    err := retryCall(context.Background(), "call", 2, time.Millisecond, func() (bool, error) {
+        calls++
+        return true, errors.New("unavailable")
+    })
+    if err == nil || calls != 3 {
+        t.Fatalf("expect 3 calls and the error, got %d: %v", calls, err)
+    }
+
+    calls = 0
+    err = retryCall(context.Background(), "call", 2, time.Millisecond, func() (bool, error) {
+        calls++
+        if calls == 1 {
+            return true, errors.New("unavailable")
+        }
+        return false, nil
+    })
+    if err != nil || calls != 2 {
+        t.Fatalf("expect to pass by the second call, got %d: %v", calls, err)
+    }
+
+    calls = 0
+    err = retryCall(context.Background(), "call", 2, time.Millisecond, func() (bool, error) {
+        calls++
+        return false, errors.New("bad request")
+    })
+    if err == nil || calls != 1 {
+        t.Fatalf("expect no retry of a failure which is not retryable, got %d: %v", calls, err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    calls = 0
+    err = retryCall(ctx, "call", 2, time.Hour, func() (bool, error) {
+        calls++
+        cancel()
+        return true, errors.New("unavailable")
+    })
+    if err == nil || calls != 1 {
+        t.Fatalf("expect a done ctx to stop the retry, got %d: %v", calls, err)
+    }
+
+    if !retryStatus(503) || !retryStatus(429) || retryStatus(400) || retryStatus(200) {
+        t.Fatal("unexpected retryable status")
+    }
+}
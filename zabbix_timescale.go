@@ -0,0 +1,295 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    log "github.com/sirupsen/logrus"
+)
+
+// TimescaleChunk is one chunk of a hypertable, the range is of the integer
+// clock like zabbix creates its hypertables.
+type TimescaleChunk struct {
+    Table       string
+    Schema      string
+    Name        string
+    RangeStart  int64
+    RangeEnd    int64
+    Compressed  bool
+}
+
+func (c TimescaleChunk) String() string {
+    return fmt.Sprintf("%s.%s of %s [%d, %d)", c.Schema, c.Name, c.Table, c.RangeStart, c.RangeEnd)
+}
+
+// the rows written into a chunk between two progress logs
+const timescaleProgressRows = 100000
+
+// TimescaleProgress counts the rows a sync writes into each chunk of its
+// window, the count of a chunk is logged every timescaleProgressRows rows
+// and all of them by Report at the end.
+type TimescaleProgress struct {
+    Chunks  []TimescaleChunk
+
+    mu      sync.Mutex
+    tables  map[string][]int
+    rows    []int64
+}
+
+func NewTimescaleProgress(chunks []TimescaleChunk) *TimescaleProgress {
+    p := &TimescaleProgress{
+        Chunks: chunks,
+        tables: make(map[string][]int),
+        rows: make([]int64, len(chunks)),
+    }
+    for idx, chunk := range chunks {
+        p.tables[chunk.Table] = append(p.tables[chunk.Table], idx)
+    }
+    return p
+}
+
+func (p *TimescaleProgress) find(table string, clock int64) int {
+    idxs := p.tables[table]
+    // the chunks of a table are in order of their range
+    n := sort.Search(len(idxs), func(i int) bool { return p.Chunks[idxs[i]].RangeEnd > clock })
+    if n == len(idxs) || p.Chunks[idxs[n]].RangeStart > clock {
+        return -1
+    }
+    return idxs[n]
+}
+
+// Add counts the rows written into the columns of the table by the chunk of
+// their clock, it is safe for the workers of a sync and a nil progress.
+func (p *TimescaleProgress) Add(table string, columns []string, rows [][]interface{}) {
+    if p == nil {
+        return
+    }
+    clockIdx := -1
+    for idx, name := range columns {
+        if name == "clock" {
+            clockIdx = idx
+        }
+    }
+    if clockIdx < 0 {
+        return
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for _, row := range rows {
+        clock, ok := row[clockIdx].(int64)
+        if !ok {
+            continue
+        }
+        idx := p.find(table, clock)
+        if idx < 0 {
+            continue
+        }
+        p.rows[idx]++
+        if p.rows[idx]%timescaleProgressRows == 0 {
+            log.WithFields(log.Fields{
+                "func": "TimescaleProgress.Add",
+                "step": "chunk.progress",
+            }).Infof("[%d/%d] chunk %s has %d rows written", idx+1, len(p.Chunks), p.Chunks[idx], p.rows[idx])
+        }
+    }
+}
+
+// Report logs the rows written into each chunk.
+func (p *TimescaleProgress) Report() {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for idx, chunk := range p.Chunks {
+        log.WithFields(log.Fields{
+            "func": "TimescaleProgress.Report",
+            "step": "chunk.progress",
+        }).Infof("[%d/%d] done chunk %s with %d rows written", idx+1, len(p.Chunks), chunk, p.rows[idx])
+    }
+}
+
+// DetectTimescale reads the version of the timescaledb extension into
+// TimescaleVersion, it is left empty for mysql or a plain postgres.
+func (db *ZabbixDB) DetectTimescale() error {
+    if db.DBDriver != "postgres" {
+        return nil
+    }
+    rows, err := db.Query("select extversion from pg_extension where extname = 'timescaledb'")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        err = rows.Scan(&db.TimescaleVersion)
+        if err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+// TimescaleAtLeast compares the detected extension version with major.minor.
+func (db *ZabbixDB) TimescaleAtLeast(major int, minor int) bool {
+    if db.TimescaleVersion == "" {
+        return false
+    }
+    parts := strings.SplitN(db.TimescaleVersion, ".", 3)
+    vMajor, _ := strconv.Atoi(parts[0])
+    vMinor := 0
+    if len(parts) > 1 {
+        vMinor, _ = strconv.Atoi(parts[1])
+    }
+    return vMajor > major || (vMajor == major && vMinor >= minor)
+}
+
+// TimescaleChunks lists the chunks of the hypertables overlapping the window
+// in chronological order, tables which are no hypertable have none.
+func (db *ZabbixDB) TimescaleChunks(tables []string, window SyncWindow) ([]TimescaleChunk, error) {
+    res := make([]TimescaleChunk, 0)
+    if !db.TimescaleAtLeast(2, 0) {
+        return res, nil
+    }
+
+    beginClock, endClock := window.Bounds()
+    for _, table := range tables {
+        rows, err := db.Query(
+            `select chunk_schema, chunk_name, range_start_integer, range_end_integer, is_compressed
+            from timescaledb_information.chunks
+            where hypertable_name = ? and range_end_integer > ? and range_start_integer < ?
+            order by range_start_integer`,
+            table,
+            beginClock,
+            endClock,
+        )
+        if err != nil {
+            return nil, err
+        }
+        for rows.Next() {
+            chunk := TimescaleChunk{Table: table}
+            err = rows.Scan(&chunk.Schema, &chunk.Name, &chunk.RangeStart, &chunk.RangeEnd, &chunk.Compressed)
+            if err != nil {
+                rows.Close()
+                return nil, err
+            }
+            res = append(res, chunk)
+        }
+        err = rows.Err()
+        rows.Close()
+        if err != nil {
+            return nil, err
+        }
+    }
+    return res, nil
+}
+
+func (db *ZabbixDB) DecompressChunk(chunk TimescaleChunk) error {
+    _, err := db.Exec("select decompress_chunk((quote_ident(?) || '.' || quote_ident(?))::regclass, true)", chunk.Schema, chunk.Name)
+    return err
+}
+
+func (db *ZabbixDB) CompressChunk(chunk TimescaleChunk) error {
+    _, err := db.Exec("select compress_chunk((quote_ident(?) || '.' || quote_ident(?))::regclass, true)", chunk.Schema, chunk.Name)
+    return err
+}
+
+// TimescaleWritable reports whether the sync can write into compressed chunks
+// of the table without decompressing them. History is inserted, which
+// timescaledb supports since 2.3, trends are upserted by TrendsUpsert, which
+// needs 2.11.
+func (db *ZabbixDB) TimescaleWritable(table string) bool {
+    if strings.HasPrefix(table, "trends") {
+        return db.TimescaleAtLeast(2, 11)
+    }
+    return db.TimescaleAtLeast(2, 3)
+}
+
+// PrepareTimescale makes the compressed chunks of the window writable before
+// a sync when the target is a timescaledb. With TimescaleDecompress they are
+// decompressed and the returned func compresses them again, without it the
+// sync fails early on versions which can not write into them, see
+// TimescaleWritable.
+// The rows written into the chunks are counted by TimescaleProgress and
+// reported by the returned func.
+func PrepareTimescale(bZDB *ZabbixDB, tables []string, window SyncWindow) (func(), error) {
+    restore := func() {}
+    if bZDB.TimescaleVersion == "" || bZDB.ValidateOnly {
+        return restore, nil
+    }
+
+    chunks, err := bZDB.TimescaleChunks(tables, window)
+    if err != nil {
+        return restore, err
+    }
+    if len(chunks) > 0 {
+        progress := NewTimescaleProgress(chunks)
+        bZDB.TimescaleProgress = progress
+        restore = progress.Report
+    }
+    compressed := make([]TimescaleChunk, 0)
+    for _, chunk := range chunks {
+        log.WithFields(log.Fields{
+            "func": "PrepareTimescale",
+            "step": "chunk.list",
+        }).Debugf("chunk %s compressed [%t] in sync window", chunk, chunk.Compressed)
+        if chunk.Compressed {
+            compressed = append(compressed, chunk)
+        }
+    }
+    log.WithFields(log.Fields{
+        "func": "PrepareTimescale",
+        "step": "chunk.list",
+    }).Infof("timescaledb %s has %d chunks in sync window [%s], %d compressed", bZDB.TimescaleVersion, len(chunks), window, len(compressed))
+    if len(compressed) == 0 {
+        return restore, nil
+    }
+
+    if !bZDB.TimescaleDecompress {
+        for _, chunk := range compressed {
+            if !bZDB.TimescaleWritable(chunk.Table) {
+                return restore, fmt.Errorf("%d chunks in sync window are compressed and timescaledb %s cannot write %s into them, first is %s, retry with -tsdb-decompress", len(compressed), bZDB.TimescaleVersion, chunk.Table, chunk)
+            }
+        }
+        return restore, nil
+    }
+
+    done := make([]TimescaleChunk, 0, len(compressed))
+    report := restore
+    compress := func() {
+        for idx, chunk := range done {
+            err := bZDB.CompressChunk(chunk)
+            if err != nil {
+                log.WithFields(log.Fields{
+                    "func": "PrepareTimescale",
+                    "step": "chunk.compress",
+                }).Errorf("[%d/%d] try to compress chunk %s again is failed: %s", idx+1, len(done), chunk, err)
+                continue
+            }
+            log.WithFields(log.Fields{
+                "func": "PrepareTimescale",
+                "step": "chunk.compress",
+            }).Infof("[%d/%d] done compress chunk %s", idx+1, len(done), chunk)
+        }
+    }
+
+    for idx, chunk := range compressed {
+        err = bZDB.DecompressChunk(chunk)
+        if err != nil {
+            // leave the chunks as they were found
+            compress()
+            return func() {}, err
+        }
+        done = append(done, chunk)
+        log.WithFields(log.Fields{
+            "func": "PrepareTimescale",
+            "step": "chunk.decompress",
+        }).Infof("[%d/%d] done decompress chunk %s", idx+1, len(compressed), chunk)
+    }
+    return func() {
+        report()
+        compress()
+    }, nil
+}
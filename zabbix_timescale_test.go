@@ -0,0 +1,59 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestTimescaleAtLeast(t *testing.T) {
+    zdb := &ZabbixDB{DBDriver: "postgres"}
+    if zdb.TimescaleAtLeast(2, 0) {
+        t.Fatal("expect no timescaledb without version")
+    }
+    zdb.TimescaleVersion = "2.10.3"
+    if !zdb.TimescaleAtLeast(2, 0) || zdb.TimescaleAtLeast(2, 11) {
+        t.Fatalf("unexpected compare for timescaledb %s", zdb.TimescaleVersion)
+    }
+    zdb.TimescaleVersion = "2.11.0"
+    if !zdb.TimescaleAtLeast(2, 11) {
+        t.Fatalf("unexpected compare for timescaledb %s", zdb.TimescaleVersion)
+    }
+}
+
+func TestTimescaleProgress(t *testing.T) {
+    p := NewTimescaleProgress([]TimescaleChunk{
+        {Table: "history", Name: "_hyper_1_1_chunk", RangeStart: 0, RangeEnd: 86400},
+        {Table: "history", Name: "_hyper_1_2_chunk", RangeStart: 86400, RangeEnd: 172800},
+        {Table: "trends", Name: "_hyper_2_3_chunk", RangeStart: 0, RangeEnd: 2592000},
+    })
+    p.Add("history", []string{"itemid", "clock", "value", "ns"}, [][]interface{}{
+        {int64(1), int64(10), 1.5, int64(0)},
+        {int64(1), int64(86400), 1.5, int64(0)},
+        {int64(1), int64(86401), 1.5, int64(0)},
+        {int64(1), int64(200000), 1.5, int64(0)},
+    })
+    // the clock is taken from the columns of the target table
+    p.Add("trends", []string{"itemid", "num", "clock"}, [][]interface{}{{int64(1), int64(60), int64(3600)}})
+    if p.rows[0] != 1 || p.rows[1] != 2 || p.rows[2] != 1 {
+        t.Fatalf("unexpected rows per chunk: %v", p.rows)
+    }
+    // nil progress of a sync without timescaledb
+    var none *TimescaleProgress
+    none.Add("history", []string{"itemid", "clock"}, [][]interface{}{{int64(1), int64(10)}})
+    none.Report()
+}
+
+func TestTimescaleWritable(t *testing.T) {
+    zdb := &ZabbixDB{DBDriver: "postgres", TimescaleVersion: "2.10.3"}
+    // trends are upserted, which compressed chunks support since 2.11
+    if !zdb.TimescaleWritable("history_uint") || zdb.TimescaleWritable("trends") || zdb.TimescaleWritable("trends_uint") {
+        t.Fatalf("unexpected writable tables for timescaledb %s", zdb.TimescaleVersion)
+    }
+    zdb.TimescaleVersion = "2.2.1"
+    if zdb.TimescaleWritable("history") {
+        t.Fatalf("unexpected writable history for timescaledb %s", zdb.TimescaleVersion)
+    }
+    zdb.TimescaleVersion = "2.11.0"
+    if !zdb.TimescaleWritable("trends") {
+        t.Fatalf("unexpected readonly trends for timescaledb %s", zdb.TimescaleVersion)
+    }
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/csv"
+    "fmt"
+    "math"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const DefaultVerifyBucket = 24 * time.Hour
+
+const (
+    VerifyMissing   = "missing on new"
+    VerifyExtra     = "extra on new"
+    VerifyCount     = "row count"
+    VerifyClocks    = "clock count"
+    VerifyChecksum  = "checksum"
+    VerifyUnmapped  = "item not mapped"
+)
+
+// VerifyBucket is the aggregate of the rows of an item in one time bucket,
+// Sum, Min and Max are of the value, of value_avg, value_min and value_max for
+// trends and of the length of the value for the tables of strings.
+type VerifyBucket struct {
+    Count   int64
+    Clocks  int64
+    Sum     float64
+    Min     float64
+    Max     float64
+}
+
+// VerifyIssue is a discrepancy of a bucket of an item between the old table
+// and the table of its counterpart on the new zabbix.
+type VerifyIssue struct {
+    Host    string
+    Key     string
+    Table   string
+    ToTable string
+    Bucket  int64
+    Issue   string
+    Old     VerifyBucket
+    New     VerifyBucket
+}
+
+func verifyAggregates(table string) string {
+    switch {
+    case strings.HasPrefix(table, "trends"):
+        return "sum(value_avg), min(value_min), max(value_max)"
+    case table == "history" || table == "history_uint":
+        return "sum(value), min(value), max(value)"
+    }
+    return "sum(char_length(value)), min(char_length(value)), max(char_length(value))"
+}
+
+// VerifyBuckets aggregates the rows of the item inside of the window by the
+// buckets of seconds, keyed by the begin clock of the bucket.
+func (db *ZabbixDB) VerifyBuckets(table string, itemid int, window SyncWindow, bucket int64) (map[int64]VerifyBucket, error) {
+    beginClock, endClock := window.Bounds()
+    bucketExpr := fmt.Sprintf("clock - clock %% %d", bucket)
+    rows, err := db.Query(
+        fmt.Sprintf(
+            "select %s, count(*), count(distinct clock), %s from %s where itemid = ? and clock >= ? and clock < ? group by %s",
+            bucketExpr, verifyAggregates(table), table, bucketExpr,
+        ),
+        itemid, beginClock, endClock,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    res := make(map[int64]VerifyBucket)
+    for rows.Next() {
+        var clock int64
+        var b VerifyBucket
+        var sum, min, max sql.NullString
+        err = rows.Scan(&clock, &b.Count, &b.Clocks, &sum, &min, &max)
+        if err != nil {
+            return nil, err
+        }
+        // decimal sums of mysql and numeric of postgres come as strings
+        b.Sum, _ = strconv.ParseFloat(sum.String, 64)
+        b.Min, _ = strconv.ParseFloat(min.String, 64)
+        b.Max, _ = strconv.ParseFloat(max.String, 64)
+        res[clock] = b
+    }
+    return res, rows.Err()
+}
+
+func verifyEqual(a float64, b float64) bool {
+    return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// CompareBuckets returns the issues of the buckets of an item, the checksums
+// are only compared when the rows stay in a table of the same kind.
+func CompareBuckets(aBuckets map[int64]VerifyBucket, bBuckets map[int64]VerifyBucket, checksum bool) map[int64]string {
+    res := make(map[int64]string)
+    for clock, o := range aBuckets {
+        n, ok := bBuckets[clock]
+        switch {
+        case !ok:
+            res[clock] = VerifyMissing
+        case o.Count != n.Count:
+            res[clock] = VerifyCount
+        case o.Clocks != n.Clocks:
+            res[clock] = VerifyClocks
+        case checksum && !(verifyEqual(o.Sum, n.Sum) && verifyEqual(o.Min, n.Min) && verifyEqual(o.Max, n.Max)):
+            res[clock] = VerifyChecksum
+        }
+    }
+    for clock := range bBuckets {
+        if _, ok := aBuckets[clock]; !ok {
+            res[clock] = VerifyExtra
+        }
+    }
+    return res
+}
+
+// VerifyItem compares the buckets of one item of the table with its mapped
+// item on the new zabbix.
+func VerifyItem(aZDB *ZabbixDB, bZDB *ZabbixDB, table string, toTable string, itemid int, mapItemid int, window SyncWindow, bucket int64) ([]VerifyIssue, error) {
+    aBuckets, err := aZDB.VerifyBuckets(table, itemid, window, bucket)
+    if err != nil {
+        return nil, err
+    }
+    bBuckets, err := bZDB.VerifyBuckets(toTable, mapItemid, window, bucket)
+    if err != nil {
+        return nil, err
+    }
+    // values are rounded or turned into strings when the value_type was changed
+    issues := CompareBuckets(aBuckets, bBuckets, table == toTable)
+
+    res := make([]VerifyIssue, 0, len(issues))
+    for clock, issue := range issues {
+        res = append(res, VerifyIssue{
+            Table: table,
+            ToTable: toTable,
+            Bucket: clock,
+            Issue: issue,
+            Old: aBuckets[clock],
+            New: bBuckets[clock],
+        })
+    }
+    sort.Slice(res, func(i, j int) bool { return res[i].Bucket < res[j].Bucket })
+    return res, nil
+}
+
+// VerifyHistory compares the history and trends of the hosts inside of the
+// window with the new zabbix by the itemid mapping, only of the table when it
+// is not empty. The discrepancies are printed and written to the csv file of
+// reportPath when it is set, it returns their number.
+func VerifyHistory(aZDB *ZabbixDB, bZDB *ZabbixDB, hostgroup string, table string, hostIdBegin int, offset uint, window SyncWindow, bucket time.Duration, reportPath string, ignoreErr bool) (int, error) {
+    log.WithFields(log.Fields{
+        "func": "VerifyHistory",
+        "step": "start",
+    }).Debugf("start verify history in window [%s]", window)
+
+    bucketSec := int64(bucket / time.Second)
+    if bucketSec <= 0 {
+        return 0, fmt.Errorf("verify bucket %s is less than a second", bucket)
+    }
+
+    hMapList, err := aZDB.GetHostMapList(hostgroup, hostIdBegin, offset)
+    if err != nil {
+        return 0, err
+    }
+
+    tables := make([]string, 0)
+    for _, t := range append(append([]string{}, HistoryTables...), TrendsTables...) {
+        if table != "" && table != t {
+            continue
+        }
+        tables = append(tables, t)
+    }
+
+    issues := make([]VerifyIssue, 0)
+    for _, hMap := range hMapList {
+        for hostid, host := range hMap {
+            iMap, err := aZDB.GetItemMap(hostid)
+            if err != nil {
+                return len(issues), err
+            }
+            mapping, err := bZDB.MappingItemId(host, iMap)
+            if err != nil {
+                return len(issues), err
+            }
+
+            itemids := make([]int, 0, len(iMap))
+            for itemid := range iMap {
+                itemids = append(itemids, itemid)
+            }
+            sort.Ints(itemids)
+
+            for _, t := range tables {
+                if _, ok := aZDB.Elastic.Index(t); ok {
+                    log.WithFields(log.Fields{
+                        "func": "VerifyHistory",
+                        "step": "elasticsearch",
+                    }).Warnf("skip verify of %s hostid [%d], it is stored in elasticsearch", t, hostid)
+                    continue
+                }
+                for _, itemid := range itemids {
+                    mapItemid, ok := mapping.Itemids[itemid]
+                    if !ok {
+                        continue
+                    }
+                    toTable := mapping.TargetTable(t, itemid)
+                    if toTable == "" {
+                        continue
+                    }
+                    if _, ok := bZDB.Elastic.Index(toTable); ok {
+                        log.WithFields(log.Fields{
+                            "func": "VerifyHistory",
+                            "step": "elasticsearch",
+                        }).Warnf("skip verify of %s itemid [%d], %s of new is stored in elasticsearch", t, itemid, toTable)
+                        continue
+                    }
+                    res, err := VerifyItem(aZDB, bZDB, t, toTable, itemid, mapItemid, window, bucketSec)
+                    if err != nil {
+                        log.WithFields(log.Fields{
+                            "func": "VerifyHistory",
+                            "step": "item",
+                        }).Errorf("verify %s hostid [%d] itemid [%d] get error: %s", t, hostid, itemid, err)
+                        if !ignoreErr {
+                            return len(issues), err
+                        }
+                        continue
+                    }
+                    for idx := range res {
+                        res[idx].Host = host
+                        res[idx].Key = iMap[itemid]
+                    }
+                    issues = append(issues, res...)
+                }
+            }
+
+            for _, itemid := range itemids {
+                if key_, ok := mapping.Unmapped[itemid]; ok {
+                    issues = append(issues, VerifyIssue{Host: host, Key: key_, Issue: VerifyUnmapped})
+                }
+            }
+        }
+    }
+
+    PrintVerifyReport(issues)
+    if reportPath != "" {
+        err = WriteVerifyReport(reportPath, issues)
+        if err != nil {
+            return len(issues), err
+        }
+    }
+    return len(issues), nil
+}
+
+func PrintVerifyReport(issues []VerifyIssue) {
+    fmt.Println("===[start: verify discrepancies]")
+    for _, i := range issues {
+        if i.Issue == VerifyUnmapped {
+            fmt.Printf("- host [%s] key [%s]: %s\n", i.Host, i.Key, i.Issue)
+            continue
+        }
+        fmt.Printf(
+            "- host [%s] key [%s] %s -> %s bucket [%s]: %s, count %d/%d clocks %d/%d sum %g/%g min %g/%g max %g/%g\n",
+            i.Host, i.Key, i.Table, i.ToTable, time.Unix(i.Bucket, 0).Format("2006-01-02 15:04:05"), i.Issue,
+            i.Old.Count, i.New.Count, i.Old.Clocks, i.New.Clocks, i.Old.Sum, i.New.Sum, i.Old.Min, i.New.Min, i.Old.Max, i.New.Max,
+        )
+    }
+    fmt.Println("===[end:   verify discrepancies]")
+}
+
+// WriteVerifyReport writes the issues to a csv file with a header line.
+func WriteVerifyReport(path string, issues []VerifyIssue) error {
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    w := csv.NewWriter(file)
+    w.Write([]string{
+        "host", "key_", "table", "new_table", "bucket", "issue",
+        "old_count", "new_count", "old_clocks", "new_clocks",
+        "old_sum", "new_sum", "old_min", "new_min", "old_max", "new_max",
+    })
+    f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+    for _, i := range issues {
+        w.Write([]string{
+            i.Host, i.Key, i.Table, i.ToTable, strconv.FormatInt(i.Bucket, 10), i.Issue,
+            strconv.FormatInt(i.Old.Count, 10), strconv.FormatInt(i.New.Count, 10),
+            strconv.FormatInt(i.Old.Clocks, 10), strconv.FormatInt(i.New.Clocks, 10),
+            f(i.Old.Sum), f(i.New.Sum), f(i.Old.Min), f(i.New.Min), f(i.Old.Max), f(i.New.Max),
+        })
+    }
+    w.Flush()
+    if err := w.Error(); err != nil {
+        return err
+    }
+    return file.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestCompareBuckets(t *testing.T) {
+    aBuckets := map[int64]VerifyBucket{
+        0: {Count: 10, Clocks: 10, Sum: 5.5, Min: 0.1, Max: 1},
+        3600: {Count: 10, Clocks: 10, Sum: 5.5, Min: 0.1, Max: 1},
+        7200: {Count: 10, Clocks: 10, Sum: 5.5, Min: 0.1, Max: 1},
+        10800: {Count: 10, Clocks: 10, Sum: 5.5, Min: 0.1, Max: 1},
+    }
+    bBuckets := map[int64]VerifyBucket{
+        0: {Count: 10, Clocks: 10, Sum: 5.5 + 1e-12, Min: 0.1, Max: 1},
+        3600: {Count: 9, Clocks: 9, Sum: 5, Min: 0.1, Max: 1},
+        7200: {Count: 10, Clocks: 10, Sum: 6, Min: 0.1, Max: 1},
+        14400: {Count: 1, Clocks: 1},
+    }
+    want := map[int64]string{
+        3600: VerifyCount,
+        7200: VerifyChecksum,
+        10800: VerifyMissing,
+        14400: VerifyExtra,
+    }
+    got := CompareBuckets(aBuckets, bBuckets, true)
+    if len(got) != len(want) {
+        t.Errorf("issues = %v, want %v", got, want)
+    }
+    for clock, issue := range want {
+        if got[clock] != issue {
+            t.Errorf("bucket %d issue = %q, want %q", clock, got[clock], issue)
+        }
+    }
+    if _, ok := CompareBuckets(aBuckets, bBuckets, false)[7200]; ok {
+        t.Error("checksum compared for a changed value_type")
+    }
+
+    dir, err := ioutil.TempDir("", "verify")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "verify.csv")
+    err = WriteVerifyReport(path, []VerifyIssue{
+        {Host: "web-01", Key: "load", Table: "history", ToTable: "history_uint", Bucket: 3600, Issue: VerifyCount, Old: aBuckets[3600], New: bBuckets[3600]},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    buf, _ := ioutil.ReadFile(path)
+    lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+    if len(lines) != 2 || lines[1] != "web-01,load,history,history_uint,3600,row count,10,9,10,9,5.5,5,0.1,0.1,1,1" {
+        t.Errorf("report = %q", lines)
+    }
+}
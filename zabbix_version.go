@@ -0,0 +1,112 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// the oldest zabbix whose api and import rules are known here
+const MinAPIMajor, MinAPIMinor = 4, 0
+
+// Capabilities is what the api of a zabbix version supports, derived from
+// the version of apiinfo.version.
+type Capabilities struct {
+    Version             string
+    // zabbix 5.2 renamed the import rule templateScreens to templateDashboards
+    TemplateDashboards  bool
+    // zabbix 5.4 removed applications and screens
+    Applications        bool
+    Screens             bool
+    // valuemaps belong to templates and hosts since zabbix 5.4
+    GlobalValuemaps     bool
+    // zabbix 6.2 keeps the groups of templates apart from the host groups
+    TemplateGroups      bool
+    // the host.get parameter for the groups of hosts, selectHostGroups since 6.2
+    SelectHostGroups    string
+}
+
+// Caps returns the capabilities of the version detected by APIVersion, an
+// unknown version is taken as the oldest one.
+func (api *ZabbixAPI) Caps() Capabilities {
+    res := Capabilities{
+        Version: api.Version,
+        TemplateDashboards: api.AtLeast(5, 2),
+        Applications: !api.AtLeast(5, 4),
+        Screens: !api.AtLeast(5, 4),
+        GlobalValuemaps: !api.AtLeast(5, 4),
+        TemplateGroups: api.AtLeast(6, 2),
+        SelectHostGroups: "selectGroups",
+    }
+    if res.TemplateGroups {
+        res.SelectHostGroups = "selectHostGroups"
+    }
+    return res
+}
+
+// ImportRules adapts the rules of configuration.import written for zabbix
+// 4.0 to the version, the renamed rules take the flags of the old ones.
+func (c Capabilities) ImportRules(rules map[string]interface{}) map[string]interface{} {
+    if c.TemplateDashboards {
+        if v, ok := rules["templateScreens"]; ok {
+            rules["templateDashboards"] = v
+            delete(rules, "templateScreens")
+        }
+    }
+    if !c.Applications {
+        delete(rules, "applications")
+    }
+    if !c.Screens {
+        delete(rules, "screens")
+    }
+    if c.TemplateGroups {
+        if v, ok := rules["groups"]; ok {
+            rules["host_groups"] = v
+            rules["template_groups"] = v
+            delete(rules, "groups")
+        }
+    }
+    return rules
+}
+
+func parseVersion(version string) (int, int, bool) {
+    parts := strings.SplitN(version, ".", 3)
+    if len(parts) < 2 {
+        return 0, 0, false
+    }
+    major, err1 := strconv.Atoi(parts[0])
+    minor, err2 := strconv.Atoi(parts[1])
+    return major, minor, err1 == nil && err2 == nil
+}
+
+// CheckVersionPair fails for the versions which can not be migrated, like
+// an unknown or too old version or a new zabbix older than the old one
+// that can not import its export.
+func CheckVersionPair(aZAPI *ZabbixAPI, bZAPI *ZabbixAPI) error {
+    for _, api := range []*ZabbixAPI{aZAPI, bZAPI} {
+        if _, _, ok := parseVersion(api.Version); !ok {
+            return fmt.Errorf("unknown api version [%s] of [%s]", api.Version, api.url)
+        }
+        if !api.AtLeast(MinAPIMajor, MinAPIMinor) {
+            return fmt.Errorf("cannot support zabbix %s of [%s], support for %d.%d and later", api.Version, api.url, MinAPIMajor, MinAPIMinor)
+        }
+    }
+    aMajor, aMinor, _ := parseVersion(aZAPI.Version)
+    if !bZAPI.AtLeast(aMajor, aMinor) {
+        return fmt.Errorf("cannot migrate from zabbix %s to older zabbix %s", aZAPI.Version, bZAPI.Version)
+    }
+    return nil
+}
+
+// CheckDBVersion fails when the database is of another major version than
+// the api, like a config with the db of one zabbix and the api of another.
+func CheckDBVersion(api *ZabbixAPI, db *ZabbixDB) error {
+    major, _, ok := parseVersion(api.Version)
+    if !ok || db == nil || db.DBVersion == 0 {
+        return nil
+    }
+    if major != db.DBVersion {
+        return fmt.Errorf("db of [%s:%d] is of zabbix %d but api [%s] is of zabbix %s", db.host, db.port, db.DBVersion, api.url, api.Version)
+    }
+    return nil
+}
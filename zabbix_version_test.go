@@ -0,0 +1,66 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestCapabilities(t *testing.T) {
+    rules := func() map[string]interface{} {
+        return map[string]interface{}{
+            "groups": map[string]bool{"createMissing": true},
+            "templateScreens": map[string]bool{"createMissing": true},
+            "applications": map[string]bool{"createMissing": true},
+            "screens": map[string]bool{"createMissing": false},
+            "items": map[string]bool{"createMissing": true},
+        }
+    }
+    cases := []struct {
+        version string
+        want    []string
+    }{
+        {"4.0.30", []string{"applications", "groups", "items", "screens", "templateScreens"}},
+        {"5.2.7", []string{"applications", "groups", "items", "screens", "templateDashboards"}},
+        {"6.0.20", []string{"groups", "items", "templateDashboards"}},
+        {"7.0.0", []string{"host_groups", "items", "templateDashboards", "template_groups"}},
+    }
+    for _, c := range cases {
+        api := &ZabbixAPI{Version: c.version}
+        got := api.Caps().ImportRules(rules())
+        if len(got) != len(c.want) {
+            t.Errorf("%s rules = %v, want %v", c.version, got, c.want)
+            continue
+        }
+        for _, name := range c.want {
+            if _, ok := got[name]; !ok {
+                t.Errorf("%s rules = %v, want %v", c.version, got, c.want)
+            }
+        }
+    }
+    if (&ZabbixAPI{Version: "6.4.0"}).Caps().SelectHostGroups != "selectHostGroups" {
+        t.Error("host groups of 6.4 are not selected by selectHostGroups")
+    }
+
+    pairs := []struct {
+        old string
+        new string
+        ok  bool
+    }{
+        {"4.0.30", "6.0.20", true},
+        {"5.0.1", "5.0.1", true},
+        {"6.0.20", "5.0.1", false},
+        {"3.4.15", "6.0.20", false},
+        {"", "6.0.20", false},
+    }
+    for _, p := range pairs {
+        err := CheckVersionPair(&ZabbixAPI{Version: p.old}, &ZabbixAPI{Version: p.new})
+        if (err == nil) != p.ok {
+            t.Errorf("pair %s -> %s get error: %v", p.old, p.new, err)
+        }
+    }
+    if CheckDBVersion(&ZabbixAPI{Version: "6.0.20"}, &ZabbixDB{DBVersion: 5}) == nil {
+        t.Error("db of zabbix 5 is accepted for api of zabbix 6")
+    }
+    if err := CheckDBVersion(&ZabbixAPI{Version: "6.0.20"}, &ZabbixDB{DBVersion: 6}); err != nil {
+        t.Error(err)
+    }
+}
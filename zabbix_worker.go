@@ -0,0 +1,271 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    SyncUnitHost  = "host"
+    SyncUnitTable = "table"
+    SyncUnitItem  = "item"
+)
+
+const (
+    SyncKindHistory = "history"
+    SyncKindTrends  = "trends"
+)
+
+// SyncTask is one unit of work for the sync workers, a whole host, a host
+// with one table, or a single item of one table when Itemid is not zero.
+// MapTable is the table of the item on the new zabbix.
+type SyncTask struct {
+    Kind        string
+    Table       string
+    Hostid      int
+    Host        string
+    Itemid      int
+    MapItemid   int
+    MapTable    string
+}
+
+func (t SyncTask) String() string {
+    if t.Itemid != 0 {
+        return fmt.Sprintf("%s table [%s] host [%s] hostid [%d] itemid [%d]", t.Kind, t.Table, t.Host, t.Hostid, t.Itemid)
+    }
+    return fmt.Sprintf("%s table [%s] host [%s] hostid [%d]", t.Kind, t.Table, t.Host, t.Hostid)
+}
+
+type SyncTaskError struct {
+    Worker  int
+    Task    SyncTask
+    Err     error
+}
+
+type SyncWorkerStat struct {
+    Worker  int
+    Done    int
+    Failed  int
+}
+
+type SyncWorkerPool struct {
+    aZDB        *ZabbixDB
+    bZDB        *ZabbixDB
+    workers     int
+    window      SyncWindow
+    ignoreErr   bool
+
+    mu          sync.Mutex
+    total       int
+    finished    int
+    Stats       []SyncWorkerStat
+    Errors      []SyncTaskError
+}
+
+func NewSyncWorkerPool(aZDB, bZDB *ZabbixDB, workers uint, window SyncWindow, ignoreErr bool) *SyncWorkerPool {
+    if workers == 0 {
+        workers = 1
+    }
+    stats := make([]SyncWorkerStat, workers)
+    for i := range stats {
+        stats[i].Worker = i
+    }
+    return &SyncWorkerPool{
+        aZDB: aZDB,
+        bZDB: bZDB,
+        workers: int(workers),
+        window: window,
+        ignoreErr: ignoreErr,
+        Stats: stats,
+        Errors: make([]SyncTaskError, 0),
+    }
+}
+
+// BuildSyncTasks splits the host list into tasks by the given unit, the item
+// unit needs the itemid mapping of every host to be resolved in advance.
+func BuildSyncTasks(aZDB, bZDB *ZabbixDB, kind string, tables []string, hMapList []HostMap, unit string) ([]SyncTask, error) {
+    res := make([]SyncTask, 0)
+    for _, hMap := range hMapList {
+        for hostid, host := range hMap {
+            switch unit {
+            case SyncUnitHost:
+                res = append(res, SyncTask{Kind: kind, Hostid: hostid, Host: host})
+            case SyncUnitTable:
+                for _, table := range tables {
+                    res = append(res, SyncTask{Kind: kind, Table: table, Hostid: hostid, Host: host})
+                }
+            case SyncUnitItem:
+                iMap, err := aZDB.GetItemMap(hostid)
+                if err != nil {
+                    return []SyncTask{}, err
+                }
+                valueTypes, err := aZDB.GetItemValueTypes(hostid)
+                if err != nil {
+                    return []SyncTask{}, err
+                }
+                mapping, err := bZDB.MappingItemId(host, iMap)
+                if err != nil {
+                    return []SyncTask{}, err
+                }
+                for itemid, key_ := range mapping.Unmapped {
+                    log.WithFields(log.Fields{
+                        "func": "BuildSyncTasks",
+                        "step": "mapping",
+                    }).Errorf("not found itemid mapping for itemid [%d] key [%s]", itemid, key_)
+                }
+                res = append(res, itemSyncTasks(kind, tables, hostid, host, valueTypes, mapping)...)
+            default:
+                return []SyncTask{}, errors.New("cannot support for the sync unit " + unit)
+            }
+        }
+    }
+    return res, nil
+}
+
+// itemSyncTasks makes a task of every mapped item for the table of its
+// value_type on the old zabbix, the other tables have no rows of it.
+func itemSyncTasks(kind string, tables []string, hostid int, host string, valueTypes map[int]int, mapping ItemMapping) []SyncTask {
+    res := make([]SyncTask, 0)
+    for _, table := range tables {
+        for itemid, mapItemid := range mapping.Itemids {
+            if valueType, ok := valueTypes[itemid]; ok && ValueTypeTable(table, valueType) != table {
+                continue
+            }
+            mapTable := mapping.TargetTable(table, itemid)
+            if mapTable == "" {
+                continue
+            }
+            res = append(res, SyncTask{
+                Kind: kind,
+                Table: table,
+                Hostid: hostid,
+                Host: host,
+                Itemid: itemid,
+                MapItemid: mapItemid,
+                MapTable: mapTable,
+            })
+        }
+    }
+    return res
+}
+
+// Run dispatches the tasks to the workers and blocks until all of them are
+// finished, or until the first failure when errors are not ignored. The
+// failed tasks are logged, with ignoreErr they do not fail the run.
+func (p *SyncWorkerPool) Run(tasks []SyncTask, tables []string) error {
+    p.total = len(tasks)
+    taskCh := make(chan SyncTask)
+    stopCh := make(chan struct{})
+    var stopOnce sync.Once
+
+    var wg sync.WaitGroup
+    for i := 0; i < p.workers; i++ {
+        wg.Add(1)
+        go func(worker int) {
+            defer wg.Done()
+            for task := range taskCh {
+                err := p.runTask(task, tables)
+                p.report(worker, task, err)
+                if err != nil && !p.ignoreErr {
+                    stopOnce.Do(func() { close(stopCh) })
+                }
+            }
+        }(i)
+    }
+
+dispatch:
+    for _, task := range tasks {
+        select {
+        case taskCh <- task:
+        case <-stopCh:
+            break dispatch
+        }
+    }
+    close(taskCh)
+    wg.Wait()
+
+    for _, stat := range p.Stats {
+        log.WithFields(log.Fields{
+            "func": "SyncWorkerPool.Run",
+            "step": "summary",
+        }).Infof("worker [%d] done %d tasks, failed %d tasks", stat.Worker, stat.Done, stat.Failed)
+    }
+
+    if len(p.Errors) == 0 {
+        return nil
+    }
+    for _, tErr := range p.Errors {
+        log.WithFields(log.Fields{
+            "func": "SyncWorkerPool.Run",
+            "step": "summary",
+        }).Errorf("worker [%d] sync %s is failed: %s", tErr.Worker, tErr.Task, tErr.Err)
+    }
+    if p.ignoreErr {
+        log.WithFields(log.Fields{
+            "func": "SyncWorkerPool.Run",
+            "step": "summary",
+        }).Warnf("%d of %d sync tasks failed, ignored", len(p.Errors), p.total)
+        return nil
+    }
+    return fmt.Errorf("%d of %d sync tasks failed, first error: %s", len(p.Errors), p.total, p.Errors[0].Err)
+}
+
+func (p *SyncWorkerPool) runTask(task SyncTask, tables []string) error {
+    switch task.Kind {
+    case SyncKindHistory:
+        if task.Itemid != 0 {
+            _, err := p.aZDB.SyncHistoryItem(p.bZDB, task.Table, task.MapTable, task.Itemid, task.MapItemid, p.window)
+            return err
+        }
+        if task.Table != "" {
+            return p.aZDB.SyncHistoryToOne(p.bZDB, task.Table, task.Hostid, task.Host, p.window, p.ignoreErr)
+        }
+        for _, hTable := range tables {
+            err := p.aZDB.SyncHistoryToOne(p.bZDB, hTable, task.Hostid, task.Host, p.window, p.ignoreErr)
+            if err != nil {
+                return err
+            }
+        }
+    case SyncKindTrends:
+        if task.Itemid != 0 {
+            _, err := p.aZDB.SyncTrendsItem(p.bZDB, task.Table, task.MapTable, task.Itemid, task.MapItemid, p.window)
+            return err
+        }
+        if task.Table != "" {
+            return p.aZDB.SyncTrendsToOne(p.bZDB, task.Table, task.Hostid, task.Host, p.window, p.ignoreErr)
+        }
+        for _, tTable := range tables {
+            err := p.aZDB.SyncTrendsToOne(p.bZDB, tTable, task.Hostid, task.Host, p.window, p.ignoreErr)
+            if err != nil {
+                return err
+            }
+        }
+    default:
+        return errors.New("cannot support for the sync kind " + task.Kind)
+    }
+    return nil
+}
+
+func (p *SyncWorkerPool) report(worker int, task SyncTask, err error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.finished++
+    if err != nil {
+        p.Stats[worker].Failed++
+        p.Errors = append(p.Errors, SyncTaskError{Worker: worker, Task: task, Err: err})
+        log.WithFields(log.Fields{
+            "func": "SyncWorkerPool.report",
+            "step": "task.failed",
+        }).Errorf("[%d/%d] worker [%d] sync %s is failed: %s", p.finished, p.total, worker, task, err)
+        return
+    }
+    p.Stats[worker].Done++
+    log.WithFields(log.Fields{
+        "func": "SyncWorkerPool.report",
+        "step": "task.done",
+    }).Infof("[%d/%d] worker [%d] done sync %s", p.finished, p.total, worker, task)
+}
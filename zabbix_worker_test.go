@@ -0,0 +1,65 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestBuildSyncTasks(t *testing.T) {
+    hMapList := []HostMap{
+        HostMap{10084: "Zabbix server"},
+        HostMap{10266: "192.168.52.61_midware"},
+    }
+
+    res, err := BuildSyncTasks(nil, nil, SyncKindHistory, HistoryTables, hMapList, SyncUnitHost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(res) != 2 {
+        t.Fatalf("expect 2 tasks by host, got %d", len(res))
+    }
+
+    res, err = BuildSyncTasks(nil, nil, SyncKindTrends, TrendsTables, hMapList, SyncUnitTable)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(res) != 4 || res[0].Table != "trends" || res[1].Table != "trends_uint" {
+        t.Fatalf("unexpected tasks by table: %v", res)
+    }
+
+    _, err = BuildSyncTasks(nil, nil, SyncKindTrends, TrendsTables, hMapList, "unknown")
+    if err == nil {
+        t.Fatal("expect error for unknown sync unit")
+    }
+}
+
+func TestItemSyncTasks(t *testing.T) {
+    mapping := ItemMapping{
+        Itemids: map[int]int{1: 101, 2: 102, 3: 103},
+        ValueTypes: map[int]int{1: ValueTypeFloat, 2: ValueTypeUint, 3: ValueTypeFloat},
+    }
+    // item 3 was uint on the old zabbix
+    valueTypes := map[int]int{1: ValueTypeFloat, 2: ValueTypeUint, 3: ValueTypeUint}
+    res := itemSyncTasks(SyncKindHistory, HistoryTables, 10084, "Zabbix server", valueTypes, mapping)
+    if len(res) != 3 {
+        t.Fatalf("expect 3 tasks by item, got %v", res)
+    }
+    for _, task := range res {
+        if ValueTypeTable(task.Table, valueTypes[task.Itemid]) != task.Table || task.MapItemid != task.Itemid+100 {
+            t.Errorf("unexpected task %v", task)
+        }
+        if task.Itemid == 3 && (task.Table != "history_uint" || task.MapTable != "history") {
+            t.Errorf("item 3 is not routed: %v", task)
+        }
+    }
+}
+
+func TestSyncWorkerPoolIgnore(t *testing.T) {
+    tasks := []SyncTask{{Kind: "unknown", Hostid: 10084, Host: "Zabbix server"}}
+    if err := NewSyncWorkerPool(nil, nil, 1, SyncWindow{}, false).Run(tasks, HistoryTables); err == nil {
+        t.Error("failed task is not returned")
+    }
+    p := NewSyncWorkerPool(nil, nil, 1, SyncWindow{}, true)
+    if err := p.Run(tasks, HistoryTables); err != nil || len(p.Errors) != 1 {
+        t.Errorf("ignored failure err = %v, errors = %v", err, p.Errors)
+    }
+}